@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// project is a Bladefile found when running a target in all projects
+type project struct {
+	dir  string
+	file string
+	name string
+	ok   bool
+	time time.Duration
+
+	// err is set if the targets of the project could not be listed
+	err error
+}
+
+// repoRoot returns the root of the git repository containing the current
+// directory, or the current directory outside of a repository
+func repoRoot() string {
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err == nil {
+		return strings.TrimSpace(string(out))
+	}
+
+	emit("Not in a git repository: %v", err)
+	wd, err := os.Getwd()
+	if err != nil {
+		emitFatal("fatal: %v\n", err)
+	}
+	return wd
+}
+
+// findProjects returns the directories under root that have a Bladefile,
+// hidden directories and directories ignored by .gitignore or .bladeignore
+// files are skipped
+func findProjects(root string) []*project {
+	var projects []*project
+	rules := parentIgnoreRules(root)
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			emit("Unable to walk %v: %v", path, err)
+			return nil
+		}
+
+		if !fi.IsDir() {
+			return nil
+		}
+		if path != root && (strings.HasPrefix(fi.Name(), ".") || rules.ignored(path, true)) {
+			emit("Skipping: %v", path)
+			return filepath.SkipDir
+		}
+		rules = append(rules, readIgnoreFiles(path)...)
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			name = path
+		}
+
+		for _, file := range []string{"Bladerunner", "Bladefile"} {
+			if _, err := os.Stat(filepath.Join(path, file)); err == nil {
+				projects = append(projects, &project{dir: path, file: file, name: name})
+				break
+			}
+		}
+		return nil
+	})
+
+	return projects
+}
+
+// executable returns the path of the running blade binary
+func executable() string {
+	path, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return path
+}
+
+// defines checks if the Bladefile of the project has the target, an error is
+// returned if the Bladefile could not be loaded. Targets of the global
+// Bladefile are not defined by the project, they would otherwise run in every
+// project.
+func (p *project) defines(target string) (bool, error) {
+	cmdArgs := append([]string{"-f", p.file}, forwardedFlags()...)
+	cmdArgs = append(cmdArgs, "-list", "-format", "json")
+
+	// errors are shown, but not the side effects reported in safe mode
+	var stderr bytes.Buffer
+	cmd := exec.Command(executable(), cmdArgs...)
+	cmd.Dir = p.dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		emit("Unable to list targets of %v: %v", p.name, err)
+		w := &prefixWriter{prefix: fmt.Sprintf("[%v] ", p.name), w: os.Stderr}
+		w.Write(stderr.Bytes())
+		w.Flush()
+		return false, err
+	}
+
+	var infos []targetInfo
+	if err := json.Unmarshal(out, &infos); err != nil {
+		emit("Unable to parse targets of %v: %v", p.name, err)
+		return false, err
+	}
+
+	for _, info := range infos {
+		if info.Name == target && !info.Global {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// forwardedFlags returns the flags that are passed on to blade in each project
+func forwardedFlags() []string {
+	var flags []string
+	if flg.safe {
+		flags = append(flags, "-safe")
+	}
+	if flg.force {
+		flags = append(flags, "-force")
+	}
+	if flg.checksum {
+		flags = append(flags, "-checksum")
+	}
+	return flags
+}
+
+// run runs the target in the directory of the project
+func (p *project) run(target string, args []string, stdout, stderr io.Writer) {
+	cmdArgs := append([]string{"-f", p.file}, forwardedFlags()...)
+	cmdArgs = append(cmdArgs, target)
+	cmdArgs = append(cmdArgs, args...)
+
+	cmd := exec.Command(executable(), cmdArgs...)
+	cmd.Dir = p.dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	p.time = time.Since(start)
+	p.ok = err == nil
+	if err != nil {
+		emit("Target %v failed in %v: %v", target, p.name, err)
+	}
+}
+
+// runAll runs the target in every project under the repository root that
+// defines it, and prints a summary. It returns the exit status.
+func runAll(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "fatal: -all needs a target\n")
+		return 2
+	}
+	target, args := args[0], args[1:]
+
+	// projects that can not be listed are reported as failed, untrusted
+	// Bladefiles are skipped since they would need a prompt each
+	root := repoRoot()
+	var projects, failed []*project
+	for _, p := range findProjects(root) {
+		file := filepath.Join(p.dir, p.file)
+		if ok, err := trusted(file); err == nil && !ok && !flg.safe {
+			fmt.Fprintf(os.Stderr, "blade: skipping untrusted blade file: %v, run `blade -allow %v` to trust it\n", file, file)
+			continue
+		}
+
+		ok, err := p.defines(target)
+		switch {
+		case err != nil:
+			p.err = err
+			failed = append(failed, p)
+		case ok:
+			projects = append(projects, p)
+		}
+	}
+
+	if len(projects) == 0 && len(failed) == 0 {
+		fmt.Fprintf(os.Stderr, "fatal: undefined target in all projects: %v\n", target)
+		return 1
+	}
+
+	queue := make(chan *project)
+	var wg sync.WaitGroup
+	for i := 0; i < flg.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				stdout := &prefixWriter{prefix: fmt.Sprintf("[%v] ", p.name), w: os.Stdout}
+				stderr := &prefixWriter{prefix: fmt.Sprintf("[%v] ", p.name), w: os.Stderr}
+				p.run(target, args, stdout, stderr)
+				stdout.Flush()
+				stderr.Flush()
+			}
+		}()
+	}
+
+	for _, p := range projects {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	return printSummary(target, append(projects, failed...))
+}
+
+// printSummary prints the status of the target in each project, it returns
+// the exit status
+func printSummary(target string, projects []*project) int {
+	sort.Sort(byProject(projects))
+
+	w, err := terminalWidth()
+	if err != nil {
+		w = 80
+	}
+
+	status := 0
+	fmt.Printf("\nSummary: %v\n", target)
+	for _, p := range projects {
+		s := statusOK
+		if !p.ok {
+			s = statusFail
+			status = 1
+		}
+
+		message := fmt.Sprintf("%v (%v)", p.name, p.time.Round(time.Millisecond))
+		if p.err != nil {
+			message = fmt.Sprintf("%v (unable to list targets: %v)", p.name, p.err)
+		}
+		fmt.Print(statusLine(w, message, s))
+	}
+
+	return status
+}
+
+type byProject []*project
+
+func (p byProject) Len() int           { return len(p) }
+func (p byProject) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byProject) Less(i, j int) bool { return p[i].name < p[j].name }
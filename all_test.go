@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the test binary as blade when BLADE_TEST_MAIN is set, tests
+// of -all use it as the blade of the projects
+func TestMain(m *testing.M) {
+	if os.Getenv("BLADE_TEST_MAIN") == "1" {
+		main()
+		exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// blade runs the test binary as blade in dir
+func blade(dir string, args ...string) (string, error) {
+	cmd := exec.Command(executable(), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"BLADE_TEST_MAIN=1",
+		"XDG_CONFIG_HOME="+filepath.Join(dir, ".config"),
+		"GIT_CEILING_DIRECTORIES="+filepath.Dir(dir),
+	)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestAllSafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	violation := filepath.Join(dir, "svc", "SAFE_VIOLATED")
+	if err := os.Mkdir(filepath.Join(dir, "svc"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bladefile := `function target.touch() blade.sh("touch ` + violation + `") end`
+	if err := ioutil.WriteFile(filepath.Join(dir, "svc", "Bladefile"), []byte(bladefile), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := blade(dir, "-safe", "-all", "touch")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	if _, err := os.Stat(violation); err == nil {
+		t.Errorf("side effect performed in safe mode")
+	}
+	if !strings.Contains(out, "[svc]   [touch] blade.sh touch "+violation) {
+		t.Errorf("expected the blocked side effect to be reported, got:\n%v", out)
+	}
+}
+
+func TestAllSkip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bladefile := `function target.build() print("built") end`
+	files := map[string]string{
+		".gitignore":                 "node_modules/\n",
+		"svc/Bladefile":              bladefile,
+		"node_modules/pkg/Bladefile": bladefile,
+		"untrusted/Bladefile":        bladefile,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if out, err := blade(dir, "-allow", "svc/Bladefile", "node_modules/pkg/Bladefile"); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	out, err := blade(dir, "-all", "build")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	if !strings.Contains(out, "[svc] built") {
+		t.Errorf("expected build to run in svc, got:\n%v", out)
+	}
+	if strings.Contains(out, "node_modules") {
+		t.Errorf("expected ignored directories to be skipped, got:\n%v", out)
+	}
+	if !strings.Contains(out, "skipping untrusted blade file: "+filepath.Join(dir, "untrusted", "Bladefile")) {
+		t.Errorf("expected the untrusted Bladefile to be skipped, got:\n%v", out)
+	}
+}
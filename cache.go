@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// stateDirName is the directory, next to the Bladefile, where blade keeps
+// its state between invocations
+const stateDirName = ".blade"
+
+var (
+	// fingerprints are the checksums of the targets last successful runs
+	fingerprints   map[string]string
+	fingerprintsMu sync.Mutex
+)
+
+// stateDir returns the state directory of the Bladefile
+func stateDir(bladefile string) string {
+	return filepath.Join(filepath.Dir(bladefile), stateDirName)
+}
+
+// fingerprint returns a checksum of the name, arguments and the content of
+// the sources of the target.
+func (t *target) fingerprint(name string, args []string) (string, error) {
+	files, err := glob(t.sources)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	json.NewEncoder(h).Encode(append([]string{name}, args...))
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+
+		io.WriteString(h, file+"\x00")
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, "\x00")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadFingerprints reads the fingerprint store, the lock must be held
+func loadFingerprints() {
+	if fingerprints != nil {
+		return
+	}
+
+	fingerprints = make(map[string]string)
+	buf, err := ioutil.ReadFile(filepath.Join(stateDir(bladefile), "fingerprints.json"))
+	if err != nil {
+		emit("No fingerprints loaded: %v", err)
+		return
+	}
+
+	if err := json.Unmarshal(buf, &fingerprints); err != nil {
+		emit("Ignoring corrupt fingerprints: %v", err)
+	}
+}
+
+// lookupFingerprint returns the stored fingerprint of the target
+func lookupFingerprint(name string) string {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+
+	loadFingerprints()
+	return fingerprints[name]
+}
+
+// storeFingerprint saves the fingerprint of the target
+func storeFingerprint(name, fingerprint string) error {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+
+	loadFingerprints()
+	fingerprints[name] = fingerprint
+
+	dir := stateDir(bladefile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(fingerprints, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "fingerprints.json"), buf, 0644)
+}
+
+// cleanCache removes the state directory of the Bladefile
+func cleanCache(bladefile string) {
+	dir := stateDir(bladefile)
+	emit("Removing state directory: %v", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		emitFatal("fatal: %v\n", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// cachedCompgen memoizes the result of a completion function on disk, so
+// slow completions are only computed once per ttl.
+type cachedCompgen struct {
+	// fn is nil when restored from the snapshot
+	fn  *funcCompgen
+	ttl time.Duration
+
+	// key derives the cache key from the completion words, the default key is
+	// the words before the cursor
+	key *lua.LFunction
+}
+
+// cacheEntry is a completion result stored on disk
+type cacheEntry struct {
+	Time       time.Time   `json:"time"`
+	Candidates [][2]string `json:"candidates,omitempty"`
+	Files      bool        `json:"files,omitempty"`
+	Dirs       bool        `json:"dirs,omitempty"`
+	Glob       string      `json:"glob,omitempty"`
+}
+
+func (cc *cachedCompgen) compgen(L *lua.LState, compWords []string, compCWords int) *completion {
+	key := cc.cacheKey(L, compWords, compCWords)
+	if c, ok := cc.lookup(key); ok {
+		return c
+	}
+
+	c := cc.fn.compgen(L, compWords, compCWords)
+	cc.store(key, c)
+	return c
+}
+
+// cacheKey returns the file name of the cache entry for the completion words
+func (cc *cachedCompgen) cacheKey(L *lua.LState, compWords []string, compCWords int) string {
+	var key string
+	if cc.key == nil {
+		key = defaultCacheKey(compWords, compCWords)
+	} else {
+		tbl := L.NewTable()
+		for _, v := range compWords {
+			tbl.Append(lua.LString(v))
+		}
+
+		if err := L.CallByParam(lua.P{
+			Fn:      cc.key,
+			NRet:    1,
+			Protect: true,
+		}, tbl, lua.LNumber(compCWords)); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			exit(1)
+		}
+		key = L.Get(-1).String()
+		L.Pop(1)
+	}
+
+	// the target name is the first word
+	target := ""
+	if len(compWords) > 0 {
+		target = compWords[0]
+	}
+
+	sum := sha256.Sum256([]byte(target + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultCacheKey is the words before the cursor and the cursor position
+func defaultCacheKey(compWords []string, compCWords int) string {
+	if compCWords < len(compWords) {
+		compWords = compWords[:compCWords]
+	}
+	return fmt.Sprintf("%v\x00%v", compCWords, strings.Join(compWords, "\x00"))
+}
+
+// cacheFile returns the path of a cache entry
+func cacheFile(key string) string {
+	return filepath.Join(stateDir(bladefile), "compgen", key+".json")
+}
+
+// lookup returns a cached completion that has not expired
+func (cc *cachedCompgen) lookup(key string) (*completion, bool) {
+	if flg.compRefresh {
+		return nil, false
+	}
+
+	buf, err := ioutil.ReadFile(cacheFile(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		emit("Ignoring corrupt completion cache: %v", err)
+		return nil, false
+	}
+
+	if time.Since(entry.Time) > cc.ttl {
+		emit("Completion cache expired: %v", key)
+		return nil, false
+	}
+
+	c := &completion{files: entry.Files, dirs: entry.Dirs, glob: entry.Glob}
+	for _, cand := range entry.Candidates {
+		c.candidates = append(c.candidates, candidate{value: cand[0], description: cand[1]})
+	}
+
+	emit("Completion cache hit: %v", key)
+	return c, true
+}
+
+// store saves the completion in the cache
+func (cc *cachedCompgen) store(key string, c *completion) {
+	if flg.safe {
+		return
+	}
+
+	entry := cacheEntry{Time: time.Now(), Files: c.files, Dirs: c.dirs, Glob: c.glob}
+	for _, cand := range c.candidates {
+		entry.Candidates = append(entry.Candidates, [2]string{cand.value, cand.description})
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		emit("Unable to encode completion: %v", err)
+		return
+	}
+
+	file := cacheFile(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		emit("Unable to cache completion: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file, buf, 0644); err != nil {
+		emit("Unable to cache completion: %v", err)
+	}
+}
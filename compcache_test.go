@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// counter returns a completion function that completes the number of times
+// it has been called
+func counter(t *testing.T, L *lua.LState) *funcCompgen {
+	err := L.DoString(`local calls = 0
+		return function()
+			calls = calls + 1
+			return {"v" .. calls}
+		end`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fn := L.Get(-1).(*lua.LFunction)
+	L.Pop(1)
+	return &funcCompgen{f: fn}
+}
+
+func TestCachedCompgen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedBladefile, savedRefresh := bladefile, flg.compRefresh
+	defer func() { bladefile, flg.compRefresh = savedBladefile, savedRefresh }()
+	bladefile = filepath.Join(dir, "Bladefile")
+
+	L := lua.NewState()
+	defer L.Close()
+
+	if err := L.DoString(`return function() return "same" end`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	constKey := L.Get(-1).(*lua.LFunction)
+	L.Pop(1)
+
+	byWords := &cachedCompgen{fn: counter(t, L), ttl: time.Hour}
+	byKey := &cachedCompgen{fn: counter(t, L), ttl: time.Hour, key: constKey}
+
+	tests := []struct {
+		name    string
+		cc      *cachedCompgen
+		words   []string
+		cword   int
+		refresh bool
+		ttl     time.Duration
+		value   string
+	}{
+		{name: "first", cc: byWords, words: []string{"deploy", ""}, cword: 1, value: "v1"},
+		{name: "cached", cc: byWords, words: []string{"deploy", ""}, cword: 1, value: "v1"},
+		{name: "words after the cursor", cc: byWords, words: []string{"deploy", "", "x"}, cword: 1, value: "v1"},
+		{name: "other words", cc: byWords, words: []string{"deploy", "--env", ""}, cword: 2, value: "v2"},
+		{name: "refresh", cc: byWords, words: []string{"deploy", ""}, cword: 1, refresh: true, value: "v3"},
+		{name: "refreshed", cc: byWords, words: []string{"deploy", ""}, cword: 1, value: "v3"},
+		{name: "expired", cc: byWords, words: []string{"deploy", ""}, cword: 1, ttl: time.Nanosecond, value: "v4"},
+		{name: "key", cc: byKey, words: []string{"deploy", "a"}, cword: 1, value: "v1"},
+		{name: "same key", cc: byKey, words: []string{"deploy", "--env", "b"}, cword: 2, value: "v1"},
+		{name: "other target", cc: byKey, words: []string{"release", "a"}, cword: 1, value: "v2"},
+	}
+
+	for _, test := range tests {
+		flg.compRefresh = test.refresh
+		test.cc.ttl = time.Hour
+		if test.ttl != 0 {
+			test.cc.ttl = test.ttl
+		}
+
+		c := test.cc.compgen(L, test.words, test.cword)
+		if len(c.candidates) != 1 || c.candidates[0].value != test.value {
+			t.Errorf("%v: expected %v, got %+v", test.name, test.value, c.candidates)
+		}
+	}
+}
@@ -10,14 +10,79 @@ import (
 )
 
 type compgenerator interface {
-	compgen(L *lua.LState, compWords []string, compCWords int) string
+	compgen(L *lua.LState, compWords []string, compCWords int) *completion
+}
+
+// candidate is a completion value with an optional description
+type candidate struct {
+	value       string
+	description string
+}
+
+// completion is the result of a completion. Besides the candidates the shell
+// can be told to complete file names, directories or files matching a glob.
+type completion struct {
+	candidates []candidate
+	files      bool
+	dirs       bool
+	glob       string
+}
+
+// words returns a completion of the space separated words in s
+func words(s string) *completion {
+	c := &completion{}
+	for _, word := range strings.Fields(s) {
+		c.candidates = append(c.candidates, candidate{value: word})
+	}
+	return c
+}
+
+// print writes the completion to stdout. The legacy format is the values
+// separated by spaces. The line format has one candidate per line with the
+// value and description separated by a tab, directives are lines starting with
+// a colon: ":files", ":dirs" and ":glob <pattern>". Values starting with a
+// colon are escaped with an extra colon.
+func (c *completion) print(lines bool) {
+	if !lines {
+		values := make([]string, len(c.candidates))
+		for i, cand := range c.candidates {
+			values[i] = cand.value
+		}
+		fmt.Printf("%v", strings.Join(values, " "))
+		return
+	}
+
+	for _, cand := range c.candidates {
+		value := cand.value
+		if strings.HasPrefix(value, ":") {
+			value = ":" + value
+		}
+
+		if cand.description != "" {
+			value = value + "\t" + strings.Replace(cand.description, "\n", " ", -1)
+		}
+		fmt.Println(value)
+	}
+
+	if c.files {
+		fmt.Println(":files")
+	}
+	if c.dirs {
+		fmt.Println(":dirs")
+	}
+	if c.glob != "" {
+		fmt.Printf(":glob %v\n", c.glob)
+	}
 }
 
 type funcCompgen struct {
 	f *lua.LFunction
 }
 
-func (sc *funcCompgen) compgen(L *lua.LState, compWords []string, compCWords int) string {
+// compgen calls the Lua completion function. It can return a string of space
+// separated values, or a table of values or {value=..., description=...}
+// tables, with the optional fields files, dirs and glob.
+func (sc *funcCompgen) compgen(L *lua.LState, compWords []string, compCWords int) *completion {
 	tbl := L.NewTable()
 	for _, v := range compWords {
 		tbl.Append(lua.LString(v))
@@ -29,22 +94,52 @@ func (sc *funcCompgen) compgen(L *lua.LState, compWords []string, compCWords int
 		Protect: true,
 	}, tbl, lua.LNumber(compCWords)); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	ret := L.Get(-1)
 	L.Pop(1)
 
 	emit("Got %v", ret.String())
-	return ret.String()
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return &completion{}
+	case *lua.LTable:
+		return tableCompletion(ret)
+	default:
+		return words(ret.String())
+	}
+}
+
+// tableCompletion converts a completion table returned from Lua
+func tableCompletion(tbl *lua.LTable) *completion {
+	c := &completion{
+		files: lua.LVAsBool(tbl.RawGetString("files")),
+		dirs:  lua.LVAsBool(tbl.RawGetString("dirs")),
+		glob:  lua.LVAsString(tbl.RawGetString("glob")),
+	}
+
+	for i := 1; i <= tbl.Len(); i++ {
+		switch v := tbl.RawGetInt(i).(type) {
+		case *lua.LTable:
+			c.candidates = append(c.candidates, candidate{
+				value:       lua.LVAsString(v.RawGetString("value")),
+				description: lua.LVAsString(v.RawGetString("description")),
+			})
+		default:
+			c.candidates = append(c.candidates, candidate{value: lua.LVAsString(v)})
+		}
+	}
+
+	return c
 }
 
 type strCompgen struct {
 	s string
 }
 
-func (sc *strCompgen) compgen(L *lua.LState, compWords []string, compCWords int) string {
-	return sc.s
+func (sc *strCompgen) compgen(L *lua.LState, compWords []string, compCWords int) *completion {
+	return words(sc.s)
 }
 
 func shift(slice []string) []string {
@@ -56,11 +151,44 @@ func shift(slice []string) []string {
 }
 
 func printFlags() {
-	var s []string
+	c := &completion{}
 	flag.VisitAll(func(fl *flag.Flag) {
-		s = append(s, "-"+fl.Name)
+		c.candidates = append(c.candidates, candidate{value: "-" + fl.Name, description: fl.Usage})
 	})
-	fmt.Printf("%v", strings.Join(s, " "))
+	c.print(flg.compLines)
+}
+
+// boolFlag is implemented by flags that does not take a value
+type boolFlag interface {
+	IsBoolFlag() bool
+}
+
+// isValueFlag checks if s is a command line flag that takes a value
+func isValueFlag(s string) bool {
+	fl := flag.Lookup(strings.TrimLeft(s, "-"))
+	if fl == nil || !strings.HasPrefix(s, "-") {
+		return false
+	}
+
+	b, ok := fl.Value.(boolFlag)
+	return !ok || !b.IsBoolFlag()
+}
+
+// valueFlags returns the names of the command line flags that takes a value
+func valueFlags() []string {
+	var names []string
+	flag.VisitAll(func(fl *flag.Flag) {
+		if isValueFlag("-" + fl.Name) {
+			names = append(names, fl.Name)
+		}
+	})
+	return names
+}
+
+// valueFlagPattern returns a shell case pattern of the flags that takes a
+// value, ie. -C|-f
+func valueFlagPattern() string {
+	return "-" + strings.Join(valueFlags(), "|-")
 }
 
 func compgen() {
@@ -72,7 +200,7 @@ func compgen() {
 
 	// analyse flags, since it has to start with "-" len(args) must be greater then 0
 	for len(args) > 0 {
-		if string(args[0][0]) == "-" || prev == "-f" {
+		if strings.HasPrefix(args[0], "-") || isValueFlag(prev) {
 			prev, args = args[0], shift(args)
 			if flg.compCWords == index {
 				printFlags()
@@ -84,26 +212,43 @@ func compgen() {
 		}
 	}
 
-	// setup Lua environment
-	L, _, _ := setupEnv()
+	// answer from the snapshot of the targets if possible, and only run the
+	// Bladefile if the snapshot is stale or a completion function is needed
+	var L *lua.LState
+	if !restoreSnapshot() {
+		L, _, _ = setupEnv()
+	}
 
 	// analyse runner targets
 	if flg.compCWords == index {
-		var s []string
-		for target := range subcommands {
-			if target == "" {
-				continue
-			}
-			s = append(s, target)
+		word := ""
+		if len(args) > 0 {
+			word = args[0]
 		}
-		fmt.Printf("%v", strings.Join(s, " "))
+		c := &completion{candidates: segmentCandidates(word)}
+		c.print(flg.compLines)
 		return
 	}
 
 	// pass it on to the runner target
 	target := args[0]
+	if cmd, ok := subcommands[target]; ok && cmd.dynamic && L == nil {
+		if cc, ok := cmd.compgen.(*cachedCompgen); ok {
+			if c, ok := cc.lookup(cc.cacheKey(L, args, flg.compCWords-index)); ok {
+				c.print(flg.compLines)
+				return
+			}
+		}
+
+		subcommands = make(targets)
+		L, _, _ = setupEnv()
+	}
+
 	if cmd, ok := subcommands[target]; ok && cmd.compgen != nil {
-		fmt.Printf("%v", cmd.compgen.compgen(L, args, flg.compCWords-index))
+		cmd.compgen.compgen(L, args, flg.compCWords-index).print(flg.compLines)
+	} else if ok && len(cmd.params) > 0 {
+		pc := &paramCompgen{params: cmd.params}
+		pc.compgen(L, args, flg.compCWords-index).print(flg.compLines)
 	}
 
 }
@@ -112,10 +257,21 @@ func compgen() {
 func generateBashConfig() {
 	conf := `_blade()
 {
-    local cur prev opts
+    local cur prev words cword i flags=()
     COMPREPLY=()
-    cur="${COMP_WORDS[COMP_CWORD]}"
-    prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+    # namespaced targets contain ":", which bash splits words on
+    if [[ $(declare -f _get_comp_words_by_ref) ]]; then
+      _get_comp_words_by_ref -n : cur prev words cword
+    else
+      # split the line up to the cursor on white space only
+      local before=${COMP_LINE:0:COMP_POINT}
+      read -ra words <<< "${before}"
+      [[ -z ${before} || ${before} == *[[:space:]] ]] && words+=( "" )
+      cword=$(( ${#words[@]} - 1 ))
+      cur="${words[cword]}"
+      prev="${words[cword-1]}"
+    fi
 
     if [[ ${prev} == -f ]]; then
       if  [[ $(declare -f _filedir) ]]; then
@@ -125,15 +281,238 @@ func generateBashConfig() {
       fi
       return 0
     fi
+    if [[ ${prev} == -C ]]; then
+      COMPREPLY=( $(compgen -d -- ${cur}) )
+      return 0
+    fi
+
+    # the blade file and the directory apply to the completion too
+    for (( i = 1; i < cword; i++ )); do
+      case ${words[i]} in
+      -f|-C)
+        flags+=( "${words[i]}" "${words[i+1]}" )
+        (( i++ ))
+        ;;
+      ` + valueFlagPattern() + `)
+        (( i++ ))
+        ;;
+      -*)
+        ;;
+      *)
+        break
+        ;;
+      esac
+    done
+
+    local line values=()
+    while IFS= read -r line; do
+      case "${line}" in
+      :files)
+        COMPREPLY+=( $(compgen -f -- "${cur}") )
+        ;;
+      :dirs)
+        COMPREPLY+=( $(compgen -d -- "${cur}") )
+        ;;
+      ":glob "*)
+        COMPREPLY+=( $(compgen -d -- "${cur}") $(compgen -f -X "!${line#:glob }" -- "${cur}") )
+        ;;
+      *)
+        [[ ${line} == ::* ]] && line=${line:1}
+        values+=( "${line%%$'\t'*}" )
+        ;;
+      esac
+    done < <(blade "${flags[@]}" -compgen -comp-lines -comp-cwords $cword "${words[@]}")
 
-    flags=$(echo "${COMP_WORDS[@]}")
-    flag=$(expr "${flags}" : '.*\(-f [^ ]* *\)')
+    for line in "${values[@]}"; do
+      if [[ ${line} == "${cur}"* ]]; then
+        COMPREPLY+=( "$(printf '%q' "${line}")" )
+      fi
+    done
 
-    opts=$(blade $flag -compgen -comp-cwords $COMP_CWORD ${COMP_WORDS[@]})
-    COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+    # complete a namespace without a trailing space
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *: ]]; then
+      compopt -o nospace 2>/dev/null
+    fi
+    if [[ $(declare -f __ltrim_colon_completions) ]]; then
+      __ltrim_colon_completions "${cur}"
+    else
+      # bash only replaces the part of the word after the last ":" or "=", if
+      # they are word breaks
+      local breaks=""
+      [[ ${COMP_WORDBREAKS} == *:* ]] && breaks+=":"
+      [[ ${COMP_WORDBREAKS} == *=* ]] && breaks+="="
+      if [[ -n ${breaks} && ${cur} == *[${breaks}]* ]]; then
+        local broken=${cur%"${cur##*[${breaks}]}"}
+        COMPREPLY=( "${COMPREPLY[@]#"${broken}"}" )
+      fi
+    fi
     return 0
 }
+
 complete -F _blade blade
 `
 	fmt.Print(conf)
 }
+
+// blade -generate-zsh-conf > "${fpath[1]}/_blade"
+func generateZshConfig() {
+	var flags []string
+	flag.VisitAll(func(fl *flag.Flag) {
+		flags = append(flags, fmt.Sprintf("    '-%v:%v'", fl.Name, strings.Replace(fl.Usage, "'", "'\\''", -1)))
+	})
+
+	conf := `#compdef blade
+
+_blade()
+{
+    local -a flags targets described opts file
+    local i line name help target=0
+
+    flags=(
+%v
+    )
+
+    for (( i = 2; i < CURRENT; i++ )); do
+        case ${words[i-1]} in
+        %v)
+            [[ ${words[i-1]} == (-f|-C) ]] && file+=(${words[i-1]} ${words[i]})
+            continue
+            ;;
+        esac
+        if [[ ${words[i]} != -* ]]; then
+            target=$i
+            break
+        fi
+    done
+
+    if [[ ${words[CURRENT-1]} == -f ]]; then
+        _files
+        return
+    fi
+    if [[ ${words[CURRENT-1]} == -C ]]; then
+        _files -/
+        return
+    fi
+
+    if (( target == 0 )); then
+        if [[ ${words[CURRENT]} == -* ]]; then
+            _describe 'option' flags
+            return
+        fi
+
+        # blade -list prints the target name and help separated by a tab
+        targets=(${(f)"$(blade $file -list -format plain 2>/dev/null)"})
+        for line in $targets; do
+            name=${line%%%%$'\t'*}
+            help=${line#*$'\t'}
+            [[ -z $name ]] && continue
+            described+=("${name//:/\\:}:$help")
+        done
+        _describe 'target' described
+        return
+    fi
+
+    for line in ${(f)"$(blade $file -compgen -comp-lines -comp-cwords $((CURRENT-1)) ${words[1,CURRENT]} 2>/dev/null)"}; do
+        case $line in
+        :files)
+            _files
+            ;;
+        :dirs)
+            _files -/
+            ;;
+        ":glob "*)
+            _files -g "${line#:glob }"
+            ;;
+        *)
+            [[ $line == ::* ]] && line=${line#:}
+            name=${line%%%%$'\t'*}
+            help=""
+            [[ $line == *$'\t'* ]] && help=${line#*$'\t'}
+            opts+=("${name//:/\\:}:$help")
+            ;;
+        esac
+    done
+    _describe 'value' opts
+}
+
+_blade "$@"
+`
+	fmt.Printf(conf, strings.Join(flags, "\n"), valueFlagPattern())
+}
+
+// blade -generate-fish-conf > ~/.config/fish/completions/blade.fish
+func generateFishConfig() {
+	conf := `function __blade_opts
+    set -l words (commandline -opc)
+    for flag in -f -C
+        set -l idx (contains -i -- $flag $words)
+        and echo -- $flag
+        and echo -- $words[(math $idx + 1)]
+    end
+end
+
+function __blade_needs_target
+    set -l words (commandline -opc)
+    set -e words[1]
+    set -l skip 0
+    for word in $words
+        if test $skip -eq 1
+            set skip 0
+            continue
+        end
+        switch $word
+            case %v
+                set skip 1
+            case '-*'
+            case '*'
+                return 1
+        end
+    end
+    return 0
+end
+
+function __blade_args
+    set -l words (commandline -opc)
+    set -l current (commandline -ct)
+    for line in (blade (__blade_opts) -compgen -comp-lines -comp-cwords (count $words) $words $current 2>/dev/null)
+        switch $line
+            case :files
+                __fish_complete_path $current
+            case :dirs
+                __fish_complete_directories $current
+            case ':glob *'
+                set -l pattern (string replace ':glob ' '' -- $line)
+                for path in (__fish_complete_path $current)
+                    set -l name (string split \t -- $path)[1]
+                    if string match -q -- '*/' $name; or string match -q -- $pattern $name
+                        echo $path
+                    end
+                end
+            case '::*'
+                string sub -s 2 -- $line
+            case '*'
+                echo $line
+        end
+    end
+end
+
+complete -c blade -f
+complete -c blade -n '__blade_needs_target' -a '(blade (__blade_opts) -list -format plain 2>/dev/null)'
+complete -c blade -n 'not __blade_needs_target' -a '(__blade_args)'
+`
+	fmt.Printf(conf, "-"+strings.Join(valueFlags(), " -"))
+
+	flag.VisitAll(func(fl *flag.Flag) {
+		opts := ""
+		if isValueFlag("-" + fl.Name) {
+			opts = " -r"
+		}
+		if fl.Name == "f" {
+			opts = " -r -F"
+		}
+		if fl.Name == "C" {
+			opts = " -x -a '(__fish_complete_directories)'"
+		}
+		fmt.Printf("complete -c blade -n '__blade_needs_target' -o %v%v -d '%v'\n", fl.Name, opts, strings.Replace(fl.Usage, "'", "\\'", -1))
+	})
+}
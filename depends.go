@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// name returns the target name bound to fn
+func (t targets) name(fn *lua.LFunction) (string, bool) {
+	for name, subcmd := range t {
+		if subcmd.cmd == fn {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// rebind replaces the dependencies on the function from with to
+func (t targets) rebind(from, to *lua.LFunction) {
+	for _, subcmd := range t {
+		for i, fn := range subcmd.deps {
+			if fn == from {
+				subcmd.deps[i] = to
+			}
+		}
+	}
+}
+
+// describe returns where a function is defined, for error messages
+func describe(fn *lua.LFunction) string {
+	if fn.IsG || fn.Proto == nil {
+		return "builtin function"
+	}
+	return fmt.Sprintf("function at %v:%v", fn.Proto.SourceName, fn.Proto.LineDefined)
+}
+
+// dependencies returns the names of the prerequisites of a target, in the
+// order they were declared.
+func (t targets) dependencies(target string) ([]string, error) {
+	subcmd, ok := t[target]
+	if !ok {
+		return nil, errUndefinedTarget
+	}
+
+	names := make([]string, 0, len(subcmd.deps))
+	for _, fn := range subcmd.deps {
+		name, ok := t.name(fn)
+		if !ok {
+			return nil, fmt.Errorf("fatal: dependency of target %v is not a target: %v", transform(target), describe(fn))
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// order returns the targets needed to run the given targets, sorted so that
+// every prerequisite comes before the targets depending on it. Each target
+// is only listed once.
+func (t targets) order(names ...string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var (
+		result []string
+		path   []string
+		state  = make(map[string]int)
+	)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return errCycle(append(path, name))
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+
+		deps, err := t.dependencies(name)
+		if err != nil {
+			return err
+		}
+
+		for _, dep := range deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+		result = append(result, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkCycles verifies that the dependency graph of all targets is acyclic
+func (t targets) checkCycles() error {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, err := t.order(names...)
+	return err
+}
+
+// errCycle formats a dependency cycle, path ends with the repeated target
+func errCycle(path []string) error {
+	last := path[len(path)-1]
+	for i, name := range path {
+		if name == last {
+			path = path[i:]
+			break
+		}
+	}
+
+	pretty := make([]string, len(path))
+	for i, name := range path {
+		pretty[i] = transform(name)
+	}
+
+	return fmt.Errorf("fatal: dependency cycle: %v", strings.Join(pretty, " -> "))
+}
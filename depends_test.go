@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// newGraph returns targets with the dependencies, each target appends its name
+// to the global table ran when it is run, or raises an error if its name is
+// set in the global table fail
+func newGraph(t *testing.T, L *lua.LState, deps map[string][]string) targets {
+	tgts := make(targets)
+	for name := range deps {
+		fn := `return function()
+			if fail and fail["` + name + `"] then error("fail") end
+			table.insert(ran, "` + name + `")
+		end`
+		if err := L.DoString(fn); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tgts[name] = &target{cmd: L.Get(-1).(*lua.LFunction)}
+		L.Pop(1)
+	}
+
+	for name, names := range deps {
+		for _, dep := range names {
+			tgts[name].deps = append(tgts[name].deps, tgts[dep].cmd)
+		}
+	}
+	return tgts
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		deps    map[string][]string
+		targets []string
+		order   []string
+	}{
+		{
+			deps:    map[string][]string{"a": nil},
+			targets: []string{"a"},
+			order:   []string{"a"},
+		},
+		{
+			deps:    map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			targets: []string{"a"},
+			order:   []string{"c", "b", "a"},
+		},
+		{
+			// diamond, the shared prerequisite is listed once
+			deps:    map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil},
+			targets: []string{"a"},
+			order:   []string{"d", "b", "c", "a"},
+		},
+		{
+			deps:    map[string][]string{"a": {"c"}, "b": {"c"}, "c": nil},
+			targets: []string{"a", "b"},
+			order:   []string{"c", "a", "b"},
+		},
+		{
+			deps:    map[string][]string{"a": {"b"}, "b": nil, "c": nil},
+			targets: []string{"b"},
+			order:   []string{"b"},
+		},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	for _, test := range tests {
+		order, err := newGraph(t, L, test.deps).order(test.targets...)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.targets, err)
+			continue
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%v: expected %v, got %v", test.targets, test.order, order)
+		}
+	}
+}
+
+func TestCheckCycles(t *testing.T) {
+	tests := []struct {
+		deps  map[string][]string
+		cycle string
+	}{
+		{deps: map[string][]string{"a": {"b"}, "b": nil}},
+		{deps: map[string][]string{"a": {"b", "c"}, "b": {"c"}, "c": nil}},
+		{deps: map[string][]string{"a": {"a"}}, cycle: "a -> a"},
+		{deps: map[string][]string{"a": {"b"}, "b": {"a"}}, cycle: "a -> b -> a"},
+		{deps: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}}, cycle: "b -> c -> b"},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	for _, test := range tests {
+		err := newGraph(t, L, test.deps).checkCycles()
+		switch {
+		case test.cycle == "" && err != nil:
+			t.Errorf("%v: unexpected error: %v", test.deps, err)
+		case test.cycle != "" && err == nil:
+			t.Errorf("%v: expected cycle %v", test.deps, test.cycle)
+		case test.cycle != "" && !strings.HasSuffix(err.Error(), test.cycle):
+			t.Errorf("%v: expected cycle %v, got %v", test.deps, test.cycle, err)
+		}
+	}
+}
+
+func TestDependencyNotTarget(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tgts := newGraph(t, L, map[string][]string{"a": nil})
+	tgts["a"].deps = append(tgts["a"].deps, L.NewFunction(func(L *lua.LState) int { return 0 }))
+
+	if _, err := tgts.order("a"); err == nil {
+		t.Errorf("expected error for a builtin dependency")
+	}
+}
+
+func TestExecuteOnce(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	saved, savedExecuted := subcommands, executed
+	defer func() { subcommands, executed = saved, savedExecuted }()
+
+	for _, jobs := range []int{1, 4} {
+		flg.jobs = jobs
+		executed = make(map[string]bool)
+		subcommands = newGraph(t, L, map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil})
+		L.SetGlobal("ran", L.NewTable())
+
+		luaLock.Lock()
+		for _, name := range []string{"b", "a"} {
+			if err := execute(L, name, nil); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		luaLock.Unlock()
+
+		count := make(map[string]int)
+		L.GetGlobal("ran").(*lua.LTable).ForEach(func(_, name lua.LValue) {
+			count[name.String()]++
+		})
+
+		expected := map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}
+		if !reflect.DeepEqual(count, expected) {
+			t.Errorf("-j %v: expected %v, got %v", jobs, expected, count)
+		}
+	}
+	flg.jobs = 1
+}
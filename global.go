@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// globalMark is appended to the help of targets from the global Bladefile
+const globalMark = " (global)"
+
+// configDir returns the directory of the configuration of the user
+func configDir() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "blade")
+}
+
+// globalBladefile returns the path of the Bladefile with the personal targets
+// of the user, which are available in every project
+func globalBladefile() string {
+	return filepath.Join(configDir(), "Bladefile")
+}
+
+// loadGlobal loads the global Bladefile and returns its target table, or nil
+// if there is no global Bladefile
+func loadGlobal(L *lua.LState) *lua.LTable {
+	file := globalBladefile()
+	if _, err := os.Stat(file); err != nil {
+		emit("No global blade file: %v", err)
+
+		// the snapshot is stale when the global Bladefile is created
+		loadedFiles = append(loadedFiles, file)
+		return nil
+	}
+
+	cmds, err := loadFile(L, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+	return cmds
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobalOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	global := `
+function target.build() print("global build") end
+function target.deploy() print("deploy") end
+blade.depends(target.deploy, target.build)
+`
+	files := map[string]string{
+		"Bladefile":               `function target.build() print("project build") end`,
+		".config/blade/Bladefile": global,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if out, err := blade(dir, "-allow"); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	// the global target depends on the project target that overrides build
+	out, err := blade(dir, "deploy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+	if out != "project build\ndeploy\n" {
+		t.Errorf("expected the project build to run before deploy, got:\n%v", out)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"sort"
 	"strings"
+	"text/tabwriter"
 
+	"github.com/otm/blade/parser"
 	"github.com/yuin/gopher-lua"
 )
 
@@ -15,26 +18,198 @@ func printHelp(L *lua.LState) int {
 	flag.PrintDefaults()
 	fmt.Printf("\nTargets:\n")
 
-	// transform pretty prints the default key = "" (empty string)
-	transform := func(s string) string {
-		if s == "" {
-			return "<default>"
-		}
-		return s
-	}
-
 	// Sort and print targets
-	keys := make([]string, len(subcommands))
-	i := 0
-	for target := range subcommands {
-		keys[i] = target
-		i++
+	keys := make([]string, 0, len(subcommands))
+	for target, subcmd := range subcommands {
+		if subcmd.hidden() {
+			continue
+		}
+		keys = append(keys, target)
 	}
 	sort.Strings(keys)
 
+	// group nested targets by namespace, top level targets first
+	var namespaces []string
+	groups := make(map[string][]string)
 	for _, target := range keys {
-		fmt.Printf("  %v: %v\n", transform(target), strings.Trim(subcommands[target].help, "\n"))
+		ns := namespace(target)
+		if _, ok := groups[ns]; !ok && ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+		groups[ns] = append(groups[ns], target)
+	}
+	sort.Strings(namespaces)
+
+	printTargets(groups[""])
+	for _, ns := range namespaces {
+		fmt.Printf("\n%v:\n", ns)
+		printTargets(groups[ns])
 	}
 
 	return 0
 }
+
+// printTargets prints the name and help of targets
+func printTargets(names []string) {
+	for _, target := range names {
+		help := strings.Trim(subcommands[target].help, "\n")
+		if ps := subcommands[target].params; len(ps) > 0 {
+			help = strings.TrimSpace(ps.usage() + " " + help)
+		}
+		if subcommands[target].global {
+			help += globalMark
+		}
+		fmt.Printf("  %v: %v\n", transform(target), help)
+	}
+}
+
+// printTargetHelp prints the documentation of a single target
+func printTargetHelp(name string) {
+	subcmd, ok := subcommands[name]
+	if !ok {
+		fmt.Printf("fatal: undefined target: %v\n", name)
+		if names := suggestions(name); len(names) > 0 {
+			fmt.Printf("\nDid you mean?\n")
+			for _, name := range names {
+				fmt.Printf("  %v\n", name)
+			}
+		}
+		exit(1)
+	}
+
+	doc := subcmd.doc
+	if doc == nil {
+		doc = &parser.Doc{}
+	}
+
+	usage := doc.Usage
+	if len(subcmd.params) > 0 {
+		usage = strings.TrimSpace(subcmd.params.usage() + " " + usage)
+	}
+	fmt.Printf("Usage: blade %v\n", strings.TrimSpace(name+" "+usage))
+
+	summary := doc.Summary
+	if subcmd.help != doc.Short() {
+		summary = strings.Trim(subcmd.help, "\n")
+	}
+	if summary != "" {
+		fmt.Printf("\n%v\n", summary)
+	}
+
+	if doc.Description != "" {
+		fmt.Printf("\n%v\n", doc.Description)
+	}
+
+	// parameters from blade.params are documented with @param of the same name
+	type row struct{ name, description string }
+	var rows []row
+	for _, p := range subcmd.params {
+		description, _ := doc.Param(p.name)
+		rows = append(rows, row{p.usage(), description.Description})
+	}
+	for _, p := range doc.Params {
+		if subcmd.params.get(p.Name) == nil {
+			rows = append(rows, row{p.Name, p.Description})
+		}
+	}
+
+	if len(rows) > 0 {
+		fmt.Printf("\nParameters:\n")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range rows {
+			fmt.Fprintf(w, "  %v\t%v\n", r.name, r.description)
+		}
+		w.Flush()
+	}
+
+	if len(doc.Examples) > 0 {
+		fmt.Printf("\nExamples:\n")
+		for _, example := range doc.Examples {
+			fmt.Printf("  %v\n", strings.Replace(example, "\n", "\n  ", -1))
+		}
+	}
+
+	fmt.Printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "Function:\t%v\n", signature(subcmd.cmd))
+	fmt.Fprintf(w, "Defined:\t%v:%v\n", subcmd.cmd.Proto.SourceName, subcmd.cmd.Proto.LineDefined)
+	if sc, ok := subcmd.compgen.(*strCompgen); ok {
+		fmt.Fprintf(w, "Completion:\t%v\n", sc.s)
+	} else if subcmd.compgen != nil {
+		fmt.Fprintf(w, "Completion:\t<function>\n")
+	}
+	w.Flush()
+}
+
+// signature returns the parameter list of a Lua function, ie. fn(a, b, ...)
+func signature(fn *lua.LFunction) string {
+	var args []string
+	for i := 0; i < int(fn.Proto.NumParameters) && i < len(fn.Proto.DbgLocals); i++ {
+		args = append(args, fn.Proto.DbgLocals[i].Name)
+	}
+	if fn.Proto.IsVarArg != 0 {
+		args = append(args, "...")
+	}
+
+	return "function(" + strings.Join(args, ", ") + ")"
+}
+
+// suggestions returns the targets with names similar to name
+func suggestions(name string) []string {
+	var names []string
+	for target, subcmd := range subcommands {
+		if target == "" || subcmd.hidden() {
+			continue
+		}
+
+		limit := len(name) / 3
+		if limit < 2 {
+			limit = 2
+		}
+		if distance(strings.ToLower(name), strings.ToLower(target)) <= limit || strings.HasPrefix(target, name) {
+			names = append(names, target)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// distance returns the Levenshtein edit distance between a and b
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// transform pretty prints the default key = "" (empty string)
+func transform(s string) string {
+	if s == "" {
+		return "<default>"
+	}
+	return s
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// ignoreFiles are the files with ignore patterns honored by the watcher
+var ignoreFiles = []string{".gitignore", ".bladeignore"}
+
+// ignoreRule is a pattern of an ignore file, it applies to the paths below
+// the directory of the file
+type ignoreRule struct {
+	dir     string
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules of the ignore files, from the outermost directory
+// to the innermost and in the order of the file. The last matching rule wins.
+type ignoreRules []ignoreRule
+
+// matchGlob matches a doublestar glob against a slash separated path. A
+// pattern without a slash is matched against the base name only.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, err := doublestar.Match(strings.TrimPrefix(pattern, "/"), name)
+	if err != nil {
+		emit("Invalid pattern %v: %v", pattern, err)
+		return false
+	}
+	return ok
+}
+
+// readIgnoreFiles returns the rules of the ignore files in dir
+func readIgnoreFiles(dir string) ignoreRules {
+	var rules ignoreRules
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		emit("Reading ignore file: %v", filepath.Join(dir, name))
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			rule := ignoreRule{dir: dir}
+			if strings.HasPrefix(line, "!") {
+				rule.negate = true
+				line = line[1:]
+			}
+			if strings.HasSuffix(line, "/") {
+				rule.dirOnly = true
+				line = strings.TrimSuffix(line, "/")
+			}
+			rule.pattern = line
+			rules = append(rules, rule)
+		}
+		f.Close()
+	}
+
+	return rules
+}
+
+// parentIgnoreRules returns the rules of the ignore files in the parent
+// directories of dir, up to the root of the git repository
+func parentIgnoreRules(dir string) ignoreRules {
+	var dirs []string
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			// not in a git repository
+			return nil
+		}
+		dirs = append(dirs, parent)
+		d = parent
+	}
+
+	var rules ignoreRules
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules = append(rules, readIgnoreFiles(dirs[i])...)
+	}
+	return rules
+}
+
+// ignored checks if the absolute path is ignored
+func (r ignoreRules) ignored(file string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		rel, err := filepath.Rel(rule.dir, file)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		if matchGlob(rule.pattern, filepath.ToSlash(rel)) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/blade/main.go", true},
+		{"*.go", "main.lua", false},
+		{"node_modules", "node_modules", true},
+		{"node_modules", "web/app/node_modules", true},
+		{"node_modules", "node_modules_old", false},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/cmd/main.go", false},
+		{"src/**/*.go", "src/cmd/main.go", true},
+		{"src/**/*.go", "src/main.go", true},
+		{"**/gen", "a/b/gen", true},
+		{"/build", "build", true},
+		{"/build", "a/build", false},
+	}
+
+	for _, test := range tests {
+		if match := matchGlob(test.pattern, test.name); match != test.match {
+			t.Errorf("%v %v: expected %v, got %v", test.pattern, test.name, test.match, match)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	rules := ignoreRules{
+		{dir: "/repo", pattern: "*.log"},
+		{dir: "/repo", pattern: "keep.log", negate: true},
+		{dir: "/repo", pattern: "build", dirOnly: true},
+		{dir: "/repo", pattern: "/dist"},
+		{dir: "/repo/web", pattern: "gen"},
+		{dir: "/repo/web", pattern: "*.tmp"},
+		{dir: "/repo/web", pattern: "web.tmp", negate: true},
+	}
+
+	tests := []struct {
+		file    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/repo/a.log", false, true},
+		{"/repo/src/a.log", false, true},
+		{"/repo/keep.log", false, false},
+		{"/repo/src/keep.log", false, false},
+		{"/repo/build", true, true},
+		{"/repo/src/build", true, true},
+		{"/repo/build", false, false},
+		{"/repo/dist", true, true},
+		{"/repo/src/dist", true, false},
+		{"/repo/web/gen", true, true},
+		{"/repo/gen", true, false},
+		{"/repo/web/a.tmp", false, true},
+		{"/repo/a.tmp", false, false},
+		{"/repo/web/web.tmp", false, false},
+		{"/repo", true, false},
+		{"/other/a.log", false, false},
+	}
+
+	for _, test := range tests {
+		if ignored := rules.ignored(test.file, test.isDir); ignored != test.ignored {
+			t.Errorf("%v: expected %v, got %v", test.file, test.ignored, ignored)
+		}
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".git/HEAD":              "",
+		".gitignore":             "# comment\n\n*.log\nbuild/\n",
+		"web/.gitignore":         "!keep.log\n",
+		"web/.bladeignore":       "/gen\n",
+		"web/src/.gitignore":     "*.tmp\n",
+		"web/src/gen/.gitignore": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the rules of a watch of web/src, the ignore files of the parents are
+	// read first
+	web := filepath.Join(dir, "web")
+	rules := parentIgnoreRules(filepath.Join(web, "src"))
+	rules = append(rules, readIgnoreFiles(filepath.Join(web, "src"))...)
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 rules, got %v: %v", len(rules), rules)
+	}
+
+	tests := []struct {
+		file    string
+		isDir   bool
+		ignored bool
+	}{
+		{"web/src/a.log", false, true},
+		{"web/src/keep.log", false, false},
+		{"web/src/build", true, true},
+		{"web/src/a.tmp", false, true},
+		{"web/gen", true, true},
+		{"web/src/gen", true, false},
+	}
+
+	for _, test := range tests {
+		if ignored := rules.ignored(filepath.Join(dir, test.file), test.isDir); ignored != test.ignored {
+			t.Errorf("%v: expected %v, got %v", test.file, test.ignored, ignored)
+		}
+	}
+
+	if rules := parentIgnoreRules(os.TempDir()); rules != nil {
+		t.Errorf("expected no rules outside of a repository, got %v", rules)
+	}
+}
+
+func TestWatcherSkip(t *testing.T) {
+	w := &watcher{root: "/repo", excludes: []string{"node_modules", "vendor/**", "*.min.js"}}
+
+	tests := []struct {
+		name  string
+		isDir bool
+		skip  bool
+	}{
+		{"/repo/node_modules", true, true},
+		{"/repo/web/app/node_modules", true, true},
+		{"/repo/vendor/pkg", true, true},
+		{"/repo/web/vendor/pkg", true, false},
+		{"/repo/web/app.min.js", false, true},
+		{"/repo/web/app.js", false, false},
+		{"/repo/.git", true, true},
+		{"/repo/.cache", true, true},
+		{"/repo/.env", false, false},
+	}
+
+	for _, test := range tests {
+		if skip := w.skip(test.name, test.isDir); skip != test.skip {
+			t.Errorf("%v: expected %v, got %v", test.name, test.skip, skip)
+		}
+	}
+
+	w.hidden = true
+	if w.skip("/repo/.cache", true) || !w.skip("/repo/.git", true) {
+		t.Errorf("hidden: expected .cache to be watched and .git to be skipped")
+	}
+}
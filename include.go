@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/otm/blade/parser"
+	"github.com/yuin/gopher-lua"
+)
+
+// sourceComments are the parsed comments of the loaded files, by source name
+type sourceComments map[string]parser.Comments
+
+// get returns the comments of file, it is parsed on first use
+func (s sourceComments) get(file string) parser.Comments {
+	if comments, ok := s[file]; ok {
+		return comments
+	}
+
+	emit("Parsing comments: %v", file)
+	comments, err := parser.File(file)
+	if err != nil {
+		emitFatal("%v", err)
+	}
+	s[file] = comments
+	return comments
+}
+
+// Include loads another Bladefile. Its targets are registered in a namespace,
+// which defaults to the name of the directory of the file.
+func Include(L *lua.LState) int {
+	path := L.CheckString(1)
+	opts := L.OptTable(2, L.NewTable())
+
+	// relative paths are relative to the including file
+	if !filepath.IsAbs(path) {
+		if dbg, ok := L.GetStack(1); ok {
+			if _, err := L.GetInfo("S", dbg, lua.LNil); err == nil {
+				path = filepath.Join(filepath.Dir(dbg.Source), path)
+			}
+		}
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "Bladefile")
+	}
+
+	ns := lua.LVAsString(opts.RawGetString("namespace"))
+	if ns == "" {
+		ns = filepath.Base(filepath.Dir(absPath(path)))
+	}
+
+	parent, ok := L.GetGlobal("target").(*lua.LTable)
+	if !ok {
+		L.RaiseError("target table missing")
+	}
+	if parent.RawGetString(ns) != lua.LNil {
+		L.ArgError(2, fmt.Sprintf("namespace already defined: %v", ns))
+	}
+
+	checkTrust(absPath(path))
+
+	cmds, err := loadFile(L, path)
+	if err != nil {
+		L.RaiseError("unable to include %v: %v", path, err)
+	}
+
+	parent.RawSetString(ns, cmds)
+	return 0
+}
+
+// loadFile runs a Bladefile and returns its target table. The file defines its
+// targets in a table of its own, and can not replace the default target or the
+// setup and teardown of the Bladefile.
+func loadFile(L *lua.LState, path string) (*lua.LTable, error) {
+	blade := L.GetGlobal("blade").(*lua.LTable)
+	saved := make(map[string]lua.LValue)
+	for _, field := range []string{"default", "setup", "teardown"} {
+		saved[field] = blade.RawGetString(field)
+	}
+
+	parent := L.GetGlobal("target")
+	cmds := L.NewTable()
+	L.SetGlobal("cmd", cmds)
+	L.SetGlobal("target", cmds)
+
+	emit("Loading blade file: %v", path)
+	err := L.DoFile(path)
+
+	L.SetGlobal("cmd", parent)
+	L.SetGlobal("target", parent)
+	for field, value := range saved {
+		blade.RawSetString(field, value)
+	}
+
+	loadedFiles = append(loadedFiles, absPath(path))
+	return cmds, err
+}
+
+// rebase makes the relative patterns of a target relative to the directory of
+// the file it is defined in
+func rebase(fn *lua.LFunction, patterns []string) []string {
+	// global targets run in the project
+	if file := absPath(fn.Proto.SourceName); file == bladefile || file == globalBladefile() {
+		return patterns
+	}
+
+	dir := filepath.Dir(fn.Proto.SourceName)
+	rebased := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		rebased[i] = pattern
+		if !filepath.IsAbs(pattern) {
+			rebased[i] = filepath.Join(dir, pattern)
+		}
+	}
+	return rebased
+}
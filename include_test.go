@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncludeCallbackDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	svc := `
+function target.after()
+	blade.after(0, function() blade.sh("cat local.txt") end)
+end
+
+function target.every()
+	blade.every(0.01, function()
+		blade.sh("cat local.txt")
+		return false
+	end)
+end
+`
+	files := map[string]string{
+		"Bladefile":     `blade.include("svc")`,
+		"svc/Bladefile": svc,
+		"svc/local.txt": "in svc",
+	}
+	if err := os.Mkdir(filepath.Join(dir, "svc"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for _, file := range []string{"Bladefile", "svc/Bladefile"} {
+		if out, err := blade(dir, "-allow", file); err != nil {
+			t.Fatalf("unexpected error: %v\n%v", err, out)
+		}
+	}
+
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"svc:after", true},
+		// the callback aborts blade by returning false
+		{"svc:every", false},
+	}
+
+	for _, test := range tests {
+		out, err := blade(dir, test.target)
+		if test.ok != (err == nil) {
+			t.Errorf("%v: unexpected error: %v\n%v", test.target, err, out)
+		}
+		if !strings.Contains(out, "in svc") {
+			t.Errorf("%v: expected the callback to run in svc, got:\n%v", test.target, out)
+		}
+	}
+}
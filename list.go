@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// targetInfo is the machine readable description of a target
+type targetInfo struct {
+	Name    string `json:"name"`
+	Help    string `json:"help"`
+	Default bool   `json:"default"`
+	Compgen string `json:"compgen,omitempty"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Global  bool   `json:"global,omitempty"`
+	Hidden  bool   `json:"hidden,omitempty"`
+}
+
+// newTargetInfo describes the target with the name
+func newTargetInfo(name string, subcmd *target) targetInfo {
+	info := targetInfo{
+		Name:    name,
+		Help:    strings.Trim(subcmd.help, "\n"),
+		Default: name == "",
+		File:    subcmd.file,
+		Line:    subcmd.line,
+		Global:  subcmd.global,
+		Hidden:  subcmd.hidden(),
+	}
+	if sc, ok := subcmd.compgen.(*strCompgen); ok {
+		info.Compgen = sc.s
+	}
+
+	return info
+}
+
+// description returns the help text of the target for completion, global
+// targets are marked as such
+func (t targetInfo) description() string {
+	if t.Global {
+		return t.Help + globalMark
+	}
+	return t.Help
+}
+
+// targetInfos returns a description of all targets, sorted by name
+func targetInfos() []targetInfo {
+	var infos []targetInfo
+	for name, subcmd := range subcommands {
+		infos = append(infos, newTargetInfo(name, subcmd))
+	}
+
+	sort.Sort(byName(infos))
+	return infos
+}
+
+type byName []targetInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// printList prints all targets in the format, json or plain. The plain format
+// is one target per line with the name and the help text separated by a tab,
+// it is used for completion and does not list hidden targets.
+func printList(format string) {
+	infos := targetInfos()
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(infos); err != nil {
+			emitFatal("fatal: %v\n", err)
+		}
+	case "plain":
+		for _, info := range infos {
+			if info.Hidden {
+				continue
+			}
+			fmt.Printf("%v\t%v\n", info.Name, strings.Replace(info.description(), "\n", " ", -1))
+		}
+	default:
+		emitFatal("fatal: unknown format: %v, expected json or plain\n", format)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bladefile := `--build the project
+function target.build() end
+blade.compgen(target.build, "linux darwin")
+
+--check the release
+-- @hidden
+function target.check() end
+
+--run the tests
+function blade.default() end
+`
+	global := `--format the code
+function target.fmt() end
+`
+	file := filepath.Join(dir, "Bladefile")
+	globalFile := filepath.Join(dir, ".config", "blade", "Bladefile")
+	if err := os.MkdirAll(filepath.Dir(globalFile), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(bladefile), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(globalFile, []byte(global), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out, err := blade(dir, "-allow"); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	out, err := blade(dir, "-list", "-format", "json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	var infos []targetInfo
+	if err := json.Unmarshal([]byte(out), &infos); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	expected := []targetInfo{
+		{Name: "", Help: "run the tests", Default: true, File: file, Line: 10},
+		{Name: "build", Help: "build the project", Compgen: "linux darwin", File: file, Line: 2},
+		{Name: "check", Help: "check the release", File: file, Line: 7, Hidden: true},
+		{Name: "fmt", Help: "format the code", File: globalFile, Line: 2, Global: true},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Errorf("expected %+v, got %+v", expected, infos)
+	}
+
+	// the plain format skips hidden targets
+	out, err = blade(dir, "-list", "-format", "plain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+	plain := "\trun the tests\nbuild\tbuild the project\nfmt\tformat the code" + globalMark + "\n"
+	if out != plain {
+		t.Errorf("expected %q, got %q", plain, out)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// event is a callback queued by a watcher or a timer. Events are run by the
+// event loop in wait, on the main goroutine which owns the Lua state.
+type event func()
+
+var (
+	events = make(chan event, 16)
+
+	// sources is the number of watchers and timers that can queue events, the
+	// event loop ends when there are none left
+	sources   int
+	sourcesMu sync.Mutex
+)
+
+// post queues an event, it is dropped if blade is done
+func post(ev event) {
+	select {
+	case events <- ev:
+	case <-done:
+	}
+}
+
+// addSource registers a source of events, it must be called before the
+// source queues any event
+func addSource() {
+	pause()
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources++
+}
+
+// removeSource unregisters a source of events
+func removeSource() {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources--
+}
+
+// activeSources returns the number of sources of events
+func activeSources() int {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	return sources
+}
+
+// callback calls a Lua callback from the event loop, in a thread with the job
+// of the target that registered it, if any. blade is aborted if the callback
+// fails or returns false.
+func callback(L *lua.LState, owner *job, fn lua.LValue, args ...lua.LValue) {
+	if owner != nil {
+		co, _ := L.NewThread()
+		jobsMu.Lock()
+		jobs[co] = owner
+		jobsMu.Unlock()
+
+		defer func() {
+			jobsMu.Lock()
+			delete(jobs, co)
+			jobsMu.Unlock()
+		}()
+		L = co
+	}
+
+	if err := callLFunc(L, fn, args...); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+}
+
+// checkDuration returns the n:th argument, in seconds, as a duration
+func checkDuration(L *lua.LState, n int) time.Duration {
+	seconds := L.CheckNumber(n)
+	if seconds < 0 {
+		L.ArgError(n, "negative duration")
+	}
+	return time.Duration(float64(seconds) * float64(time.Second))
+}
+
+// After calls a function once, after a delay in seconds
+func After(L *lua.LState) int {
+	delay := checkDuration(L, 1)
+	fn := L.CheckFunction(2)
+	owner := callbackJob(L)
+
+	addSource()
+	time.AfterFunc(delay, func() {
+		post(func() {
+			removeSource()
+			callback(L, owner, fn)
+		})
+	})
+
+	return 0
+}
+
+// Every calls a function repeatedly, with an interval in seconds
+func Every(L *lua.LState) int {
+	interval := checkDuration(L, 1)
+	fn := L.CheckFunction(2)
+	if interval == 0 {
+		L.ArgError(1, "interval must be positive")
+	}
+	owner := callbackJob(L)
+
+	addSource()
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				post(func() {
+					callback(L, owner, fn)
+				})
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventLoop(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		lines  []string
+		ok     bool
+	}{
+		{
+			name: "after",
+			target: `
+				blade.after(0.1, function() print("late") end)
+				blade.after(0, function() print("early") end)
+			`,
+			lines: []string{"early", "late"},
+			ok:    true,
+		},
+		{
+			// callbacks are not run while the target is running
+			name: "after target",
+			target: `
+				blade.after(0, function() print("callback") end)
+				blade.sh("sleep 0.1")
+				print("target")
+			`,
+			lines: []string{"sleep 0.1", "target", "callback"},
+			ok:    true,
+		},
+		{
+			name: "nested",
+			target: `
+				blade.after(0, function()
+					print("outer")
+					blade.after(0, function() print("inner") end)
+				end)
+			`,
+			lines: []string{"outer", "inner"},
+			ok:    true,
+		},
+		{
+			name: "every",
+			target: `
+				local n = 0
+				blade.every(0.01, function()
+					n = n + 1
+					print("tick " .. n)
+					return n < 3
+				end)
+			`,
+			lines: []string{"tick 1", "tick 2", "tick 3", "user: abort"},
+			ok:    false,
+		},
+		{
+			name: "every and after",
+			target: `
+				local n = 0
+				blade.every(0.05, function()
+					n = n + 1
+					print("tick " .. n)
+					return n < 2
+				end)
+				blade.after(0, function() print("after") end)
+			`,
+			lines: []string{"after", "tick 1", "tick 2", "user: abort"},
+			ok:    false,
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "blade")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		bladefile := "function target.run()\n" + test.target + "\nend\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "Bladefile"), []byte(bladefile), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out, err := blade(dir, "-allow"); err != nil {
+			t.Fatalf("unexpected error: %v\n%v", err, out)
+		}
+
+		out, err := blade(dir, "run")
+		if test.ok != (err == nil) {
+			t.Errorf("%v: expected ok %v, got %v\n%v", test.name, test.ok, err, out)
+		}
+
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line != "watching: ctrl-c to abort" {
+				lines = append(lines, line)
+			}
+		}
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%v: expected %q, got %q", test.name, test.lines, lines)
+		}
+	}
+}
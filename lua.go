@@ -7,8 +7,10 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 	"golang.org/x/crypto/ssh/terminal"
@@ -76,6 +78,9 @@ func Compgen(L *lua.LState) int {
 
 	if v := L.ToFunction(2); v != nil {
 		var c compgenerator = &funcCompgen{f: v}
+		if opts := L.ToTable(3); opts != nil {
+			c = cachePolicy(L, opts, c.(*funcCompgen))
+		}
 		set(targetFunc, c)
 	} else if v := L.ToString(2); v != "" {
 		var c compgenerator = &strCompgen{s: v}
@@ -87,6 +92,172 @@ func Compgen(L *lua.LState) int {
 	return 0
 }
 
+// cachePolicy wraps a completion function with a cache, configured by the
+// ttl (seconds) and key fields of opts
+func cachePolicy(L *lua.LState, opts *lua.LTable, fc *funcCompgen) compgenerator {
+	ttl, ok := opts.RawGetString("ttl").(lua.LNumber)
+	if !ok || ttl <= 0 {
+		L.ArgError(3, "ttl must be a positive number")
+	}
+
+	cc := &cachedCompgen{fn: fc, ttl: time.Duration(float64(ttl) * float64(time.Second))}
+	switch key := opts.RawGetString("key").(type) {
+	case *lua.LNilType:
+	case *lua.LFunction:
+		cc.key = key
+	default:
+		L.ArgError(3, "key must be a function")
+	}
+
+	return cc
+}
+
+// Depends registers prerequisite targets that are run, once, before the target
+func Depends(L *lua.LState) int {
+	targetFunc := L.CheckFunction(1)
+	if targetFunc.IsG {
+		L.ArgError(1, "target expected, got a builtin function")
+	}
+	if L.GetTop() < 2 {
+		L.ArgError(2, "function expected")
+	}
+
+	deps := make([]*lua.LFunction, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		fn := L.CheckFunction(i)
+		if fn.IsG {
+			L.ArgError(i, "target expected, got a builtin function")
+		}
+		deps = append(deps, fn)
+	}
+
+	subcmd, name := subcommands.get(targetFunc)
+	subcmd.deps = append(subcmd.deps, deps...)
+	if isDefault(L, targetFunc) {
+		subcommands.rename(name, "")
+	}
+
+	return 0
+}
+
+// Sources registers the input files of a target, as glob patterns
+func Sources(L *lua.LState) int {
+	targetFunc := L.CheckFunction(1)
+	patterns := rebase(targetFunc, checkPatterns(L, 2))
+
+	subcmd, name := subcommands.get(targetFunc)
+	subcmd.sources = append(subcmd.sources, patterns...)
+	if isDefault(L, targetFunc) {
+		subcommands.rename(name, "")
+	}
+
+	return 0
+}
+
+// Outputs registers the files produced by a target, as glob patterns
+func Outputs(L *lua.LState) int {
+	targetFunc := L.CheckFunction(1)
+	patterns := rebase(targetFunc, checkPatterns(L, 2))
+
+	subcmd, name := subcommands.get(targetFunc)
+	subcmd.outputs = append(subcmd.outputs, patterns...)
+	if isDefault(L, targetFunc) {
+		subcommands.rename(name, "")
+	}
+
+	return 0
+}
+
+// Workdir sets the directory shell commands of a target are run in, instead of
+// the directory of the Bladefile. A relative path is relative to the file the
+// target is defined in.
+func Workdir(L *lua.LState) int {
+	targetFunc := L.CheckFunction(1)
+	dir := L.CheckString(2)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(absPath(targetFunc.Proto.SourceName)), dir)
+	}
+
+	subcmd, name := subcommands.get(targetFunc)
+	subcmd.workdir = dir
+	if isDefault(L, targetFunc) {
+		subcommands.rename(name, "")
+	}
+
+	return 0
+}
+
+// Params registers the named parameters of a target, the target is called
+// with a table of parameter values followed by the positional arguments
+func Params(L *lua.LState) int {
+	targetFunc := L.CheckFunction(1)
+	schema := L.CheckTable(2)
+
+	var ps params
+	schema.ForEach(func(_, value lua.LValue) {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			L.ArgError(2, "table of parameter tables expected")
+		}
+
+		p := &param{
+			name:     lua.LVAsString(tbl.RawGetString("name")),
+			typ:      lua.LVAsString(tbl.RawGetString("type")),
+			def:      tbl.RawGetString("default"),
+			required: lua.LVAsBool(tbl.RawGetString("required")),
+		}
+
+		if p.name == "" {
+			L.ArgError(2, "parameter name missing")
+		}
+
+		switch p.typ {
+		case "":
+			p.typ = "string"
+		case "string", "number", "bool":
+		default:
+			L.ArgError(2, fmt.Sprintf("parameter %v: unknown type: %v", p.name, p.typ))
+		}
+
+		if enum, ok := tbl.RawGetString("enum").(*lua.LTable); ok {
+			enum.ForEach(func(_, value lua.LValue) {
+				p.enum = append(p.enum, lua.LVAsString(value))
+			})
+		}
+
+		ps = append(ps, p)
+	})
+
+	subcmd, name := subcommands.get(targetFunc)
+	subcmd.params = append(subcmd.params, ps...)
+	if isDefault(L, targetFunc) {
+		subcommands.rename(name, "")
+	}
+
+	return 0
+}
+
+// checkPatterns returns all arguments from the n:th as strings, a table of
+// strings is flattened.
+func checkPatterns(L *lua.LState, n int) []string {
+	var patterns []string
+	for i := n; i <= L.GetTop(); i++ {
+		if tbl, ok := L.Get(i).(*lua.LTable); ok {
+			tbl.ForEach(func(_, value lua.LValue) {
+				patterns = append(patterns, lua.LVAsString(value))
+			})
+			continue
+		}
+		patterns = append(patterns, L.CheckString(i))
+	}
+
+	if len(patterns) == 0 {
+		L.ArgError(n, "string expected")
+	}
+
+	return patterns
+}
+
 // shOpts is the Sh function's options
 type shOpts struct {
 	noEcho  bool
@@ -120,18 +291,23 @@ func SetShell(L *lua.LState) int {
 func Sh(L *lua.LState, options ...func(opts *shOpts)) int {
 	stdoutBuf := new(bytes.Buffer)
 	stderrBuf := new(bytes.Buffer)
-	opts := &shOpts{stdout: os.Stdout}
+	opts := &shOpts{stdout: stdoutOf(L)}
 	for _, option := range options {
 		option(opts)
 	}
 
 	cmd := exec.Command(shell, "-c", L.ToString(1))
 	cmd.Stdout = io.MultiWriter(stdoutBuf, opts.stdout)
-	cmd.Stderr = io.MultiWriter(stderrBuf, os.Stderr)
+	cmd.Stderr = io.MultiWriter(stderrBuf, stderrOf(L))
+	cmd.Dir = dirOf(L)
 	if !opts.noEcho {
-		fmt.Printf("%v\n", L.ToString(1))
+		fmt.Fprintf(stdoutOf(L), "%v\n", L.ToString(1))
 	}
-	err := cmd.Run()
+
+	var err error
+	unlocked(func() {
+		err = cmd.Run()
+	})
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
@@ -142,8 +318,8 @@ func Sh(L *lua.LState, options ...func(opts *shOpts)) int {
 					return 3
 				}
 
-				L.Error(lua.LString(fmt.Sprintf("blade: Target: [%v] Error: %v", currentTarget, status.ExitStatus())), 0)
-				os.Exit(1)
+				L.Error(lua.LString(fmt.Sprintf("blade: Target: [%v] Error: %v", runningTarget(L), status.ExitStatus())), 0)
+				exit(1)
 			}
 		}
 	}
@@ -153,36 +329,70 @@ func Sh(L *lua.LState, options ...func(opts *shOpts)) int {
 	return 3
 }
 
+// Print replaces the Lua print function, output is written to the standard
+// output of the running target.
+func Print(L *lua.LState) int {
+	top := L.GetTop()
+	parts := make([]string, top)
+	for i := 1; i <= top; i++ {
+		parts[i-1] = L.ToStringMeta(L.Get(i)).String()
+	}
+
+	fmt.Fprintln(stdoutOf(L), strings.Join(parts, "\t"))
+	return 0
+}
+
 // printStatus pretty prints a status message
 func printStatus(L *lua.LState) int {
-	w, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	w, err := terminalWidth()
 	if err != nil {
 		emit("Unable to get terminal size: %v", err)
 		return 0
 	}
-	reset := "\033[0m"
-	red := "\033[31m"
-	green := "\033[32m"
-	blue := "\033[34m"
 
-	status := fmt.Sprintf("[%vudef%v]", blue, reset)
-	ok := fmt.Sprintf("[ %vok%v ]", green, reset)
-	fail := fmt.Sprintf("[%vfail%v]", red, reset)
+	status := statusUndefined
 	switch L.Get(2).Type() {
 	case lua.LTBool:
-		status = fail
+		status = statusFail
 		if L.ToBool(2) {
-			status = ok
+			status = statusOK
 		}
 	case lua.LTNumber:
-		status = fail
+		status = statusFail
 		if L.ToInt(2) == 0 {
-			status = ok
+			status = statusOK
 		}
 	}
 
-	message := L.ToString(1)
-	fmt.Printf("%v%v%v\n", message, strings.Repeat(" ", w-len(message)-len(status)+len(reset)+len(red)-1), status)
-
+	fmt.Fprint(stdoutOf(L), statusLine(w, L.ToString(1), status))
 	return 0
 }
+
+const (
+	reset = "\033[0m"
+	red   = "\033[31m"
+	green = "\033[32m"
+	blue  = "\033[34m"
+)
+
+var (
+	statusUndefined = fmt.Sprintf("[%vudef%v]", blue, reset)
+	statusOK        = fmt.Sprintf("[ %vok%v ]", green, reset)
+	statusFail      = fmt.Sprintf("[%vfail%v]", red, reset)
+)
+
+// terminalWidth returns the width of the terminal on standard output
+func terminalWidth() (int, error) {
+	w, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	return w, err
+}
+
+// statusLine returns the message with the status right aligned on a line of
+// width w
+func statusLine(w int, message, status string) string {
+	padding := w - len(message) - len(status) + len(reset) + len(red) - 1
+	if padding < 1 {
+		padding = 1
+	}
+	return fmt.Sprintf("%v%v%v\n", message, strings.Repeat(" ", padding), status)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// namespaceSep separates the namespace and the name of a nested target, ie.
+// target.docker.build is run as "blade docker:build"
+const namespaceSep = ":"
+
+// registerTargets registers the functions of tbl as targets, nested tables
+// are walked recursively and their functions are registered in a namespace.
+// Global targets do not replace targets of the project.
+func registerTargets(tbl *lua.LTable, prefix string, comments sourceComments, visited map[*lua.LTable]bool, global bool) {
+	if visited[tbl] {
+		return
+	}
+	visited[tbl] = true
+
+	tbl.ForEach(func(key, value lua.LValue) {
+		name := prefix + key.String()
+		switch v := value.(type) {
+		case *lua.LFunction:
+			if project, ok := subcommands[name]; ok && global {
+				emit(" * %v [global target, overridden]", name)
+				subcommands.drop(v)
+
+				// global targets depending on it depend on the project target
+				subcommands.rebind(v, project.cmd)
+				return
+			}
+
+			emit(" * %v [target]", name)
+			subcommand, tmp := subcommands.get(v)
+			subcommands.rename(tmp, name)
+
+			subcommand.document(comments)
+
+			// global targets run in the project
+			if global {
+				subcommand.global = true
+				subcommand.dir = filepath.Dir(bladefile)
+			}
+		case *lua.LTable:
+			emit(" * %v [namespace]", name)
+			registerTargets(v, name+namespaceSep, comments, visited, global)
+		}
+	})
+}
+
+// namespace returns the namespace of a target name, the empty string for top
+// level targets
+func namespace(name string) string {
+	if i := strings.LastIndex(name, namespaceSep); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// segmentCandidates completes a target name one segment at a time. Targets in
+// the namespace of word are candidates, and so are its nested namespaces, with
+// a trailing separator.
+func segmentCandidates(word string) []candidate {
+	prefix := ""
+	if i := strings.LastIndex(word, namespaceSep); i >= 0 {
+		prefix = word[:i+1]
+	}
+
+	var candidates []candidate
+	seen := make(map[string]bool)
+	for _, info := range targetInfos() {
+		if info.Name == "" || info.Hidden || !strings.HasPrefix(info.Name, prefix) {
+			continue
+		}
+
+		rest := info.Name[len(prefix):]
+		if i := strings.Index(rest, namespaceSep); i >= 0 {
+			ns := prefix + rest[:i+1]
+			if !seen[ns] {
+				seen[ns] = true
+				candidates = append(candidates, candidate{value: ns, description: "namespace"})
+			}
+			continue
+		}
+
+		candidates = append(candidates, candidate{value: info.Name, description: info.description()})
+	}
+
+	return candidates
+}
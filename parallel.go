@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var (
+	// luaLock must be held when running Lua code. The Lua state is not thread
+	// safe, so concurrent targets take turns running Lua and only run in
+	// parallel while waiting on shell commands.
+	luaLock sync.Mutex
+
+	// outputLock serializes writes of prefixed lines to stdout and stderr
+	outputLock sync.Mutex
+
+	// jobs maps the Lua thread of a running target to the job
+	jobs   = make(map[*lua.LState]*job)
+	jobsMu sync.Mutex
+)
+
+// job is a target running in its own Lua thread
+type job struct {
+	name   string
+	stdout io.Writer
+	stderr io.Writer
+
+	// dir is the working directory of commands, the directory set with
+	// blade.workdir or else the directory of the file the target is defined in
+	dir string
+}
+
+// result is sent by a worker when a job has finished
+type result struct {
+	name string
+	err  error
+}
+
+// unlocked releases the Lua lock while running fn, so other targets can run
+// Lua while fn is blocking.
+func unlocked(fn func()) {
+	luaLock.Unlock()
+	defer luaLock.Lock()
+	fn()
+}
+
+// jobOf returns the job running in the Lua thread L, or nil
+func jobOf(L *lua.LState) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[L]
+}
+
+// runningTarget returns the name of the target running in L
+func runningTarget(L *lua.LState) string {
+	if j := jobOf(L); j != nil {
+		return j.name
+	}
+	return ""
+}
+
+// dirOf returns the working directory of commands run by the Lua thread L
+func dirOf(L *lua.LState) string {
+	if j := jobOf(L); j != nil {
+		return j.dir
+	}
+	return ""
+}
+
+// callbackJob returns the job of callbacks registered by the Lua thread L,
+// they run in the directory of the target that registered them. It is nil
+// outside of targets.
+func callbackJob(L *lua.LState) *job {
+	j := jobOf(L)
+	if j == nil {
+		return nil
+	}
+	return &job{name: j.name, stdout: os.Stdout, stderr: os.Stderr, dir: j.dir}
+}
+
+// stdoutOf returns the writer for standard output for the Lua thread L
+func stdoutOf(L *lua.LState) io.Writer {
+	if j := jobOf(L); j != nil {
+		return j.stdout
+	}
+	return os.Stdout
+}
+
+// stderrOf returns the writer for standard error for the Lua thread L
+func stderrOf(L *lua.LState) io.Writer {
+	if j := jobOf(L); j != nil {
+		return j.stderr
+	}
+	return os.Stderr
+}
+
+// execute runs target and the prerequisites that has not already been run in
+// this invocation. Prerequisites that does not depend on each other are run
+// concurrently by up to flg.jobs workers. The Lua lock must be held.
+func execute(L *lua.LState, target string, args []string) error {
+	order, err := subcommands.order(target)
+	if err != nil {
+		return err
+	}
+
+	// remaining contains the prerequisites each pending target waits for
+	var ready []string
+	remaining := make(map[string]map[string]bool)
+	for _, name := range order {
+		if executed[name] && name != target {
+			continue
+		}
+
+		deps, err := subcommands.dependencies(name)
+		if err != nil {
+			return err
+		}
+
+		remaining[name] = make(map[string]bool)
+		for _, dep := range deps {
+			if !executed[dep] {
+				remaining[name][dep] = true
+			}
+		}
+	}
+
+	for _, name := range order {
+		if deps, ok := remaining[name]; ok && len(deps) == 0 {
+			ready = append(ready, name)
+			delete(remaining, name)
+		}
+	}
+
+	results := make(chan result)
+	running := 0
+	var failure error
+
+	unlocked(func() {
+		for {
+			for failure == nil && running < flg.jobs && len(ready) > 0 {
+				name := ready[0]
+				ready = ready[1:]
+				running++
+
+				var jobArgs []string
+				if name == target {
+					jobArgs = args
+				}
+				go work(L, name, jobArgs, results)
+			}
+
+			if running == 0 {
+				return
+			}
+
+			r := <-results
+			running--
+			if r.err != nil {
+				failure = r.err
+				continue
+			}
+
+			executed[r.name] = true
+			for _, name := range order {
+				deps, ok := remaining[name]
+				if !ok {
+					continue
+				}
+
+				delete(deps, r.name)
+				if len(deps) == 0 {
+					ready = append(ready, name)
+					delete(remaining, name)
+				}
+			}
+		}
+	})
+
+	return failure
+}
+
+// work runs a single target in a new Lua thread
+func work(L *lua.LState, name string, args []string, results chan<- result) {
+	luaLock.Lock()
+	defer luaLock.Unlock()
+
+	co, _ := L.NewThread()
+
+	j := &job{name: name, stdout: os.Stdout, stderr: os.Stderr, dir: subcommands[name].dir}
+	if subcommands[name].workdir != "" {
+		j.dir = subcommands[name].workdir
+	}
+	if flg.jobs > 1 {
+		stdout := &prefixWriter{prefix: fmt.Sprintf("[%v] ", transform(name)), w: os.Stdout}
+		stderr := &prefixWriter{prefix: fmt.Sprintf("[%v] ", transform(name)), w: os.Stderr}
+		j.stdout, j.stderr = stdout, stderr
+	}
+
+	jobsMu.Lock()
+	jobs[co] = j
+	jobsMu.Unlock()
+
+	defer func() {
+		jobsMu.Lock()
+		delete(jobs, co)
+		jobsMu.Unlock()
+	}()
+
+	lvArgs, err := subcommands[name].arguments(co, args)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", err, transform(name))
+		results <- result{name: name, err: err}
+		return
+	}
+
+	ok, fingerprint, err := subcommands[name].check(name, args)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", err, transform(name))
+	} else if ok && !flg.force {
+		fmt.Fprintf(j.stdout, "target %v is up to date\n", transform(name))
+	} else {
+		emit("Running target: %v", name)
+		err = callLFunc(co, subcommands[name].cmd, lvArgs...)
+		if err == errAbort {
+			err = fmt.Errorf("%v: %v", err, transform(name))
+		} else if fingerprint != "" && !flg.safe {
+			if serr := storeFingerprint(name, fingerprint); serr != nil {
+				fmt.Fprintf(j.stderr, "warning: unable to store fingerprint: %v\n", serr)
+			}
+		}
+	}
+
+	flush(j.stdout)
+	flush(j.stderr)
+	results <- result{name: name, err: err}
+}
+
+// prefixWriter prefixes every line with the target name. Only whole lines are
+// written to avoid interleaving output from concurrent targets.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+
+		p.writeLine(p.buf[:i])
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes any trailing data not terminated by a newline
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) > 0 {
+		p.writeLine(p.buf)
+		p.buf = nil
+	}
+}
+
+// flush flushes w if it is a prefixWriter
+func flush(w io.Writer) {
+	if p, ok := w.(*prefixWriter); ok {
+		p.Flush()
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	fmt.Fprintf(p.w, "%v%s\n", p.prefix, line)
+}
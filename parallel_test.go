@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// ran returns the names of the targets of a graph that has been run, in order
+func ran(L *lua.LState) []string {
+	var names []string
+	L.GetGlobal("ran").(*lua.LTable).ForEach(func(_, name lua.LValue) {
+		names = append(names, name.String())
+	})
+	return names
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		jobs   int
+		deps   map[string][]string
+		fail   string
+		target string
+		ran    []string
+		err    bool
+	}{
+		{
+			jobs:   1,
+			deps:   map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil},
+			target: "a",
+			ran:    []string{"d", "b", "c", "a"},
+		},
+		{
+			jobs:   4,
+			deps:   map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			target: "a",
+			ran:    []string{"c", "b", "a"},
+		},
+		{
+			// the prerequisites after a failure are not started
+			jobs:   1,
+			deps:   map[string][]string{"a": {"b", "c"}, "b": nil, "c": nil},
+			fail:   "b",
+			target: "a",
+			ran:    nil,
+			err:    true,
+		},
+		{
+			jobs:   1,
+			deps:   map[string][]string{"a": {"b", "c"}, "b": nil, "c": nil},
+			fail:   "c",
+			target: "a",
+			ran:    []string{"b"},
+			err:    true,
+		},
+		{
+			// a target is not run if a prerequisite fails
+			jobs:   4,
+			deps:   map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			fail:   "c",
+			target: "a",
+			ran:    nil,
+			err:    true,
+		},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	saved, savedExecuted := subcommands, executed
+	defer func() {
+		subcommands, executed = saved, savedExecuted
+		flg.jobs = 1
+	}()
+
+	for i, test := range tests {
+		flg.jobs = test.jobs
+		executed = make(map[string]bool)
+		subcommands = newGraph(t, L, test.deps)
+		fail := L.NewTable()
+		if test.fail != "" {
+			fail.RawSetString(test.fail, lua.LTrue)
+		}
+		L.SetGlobal("fail", fail)
+		L.SetGlobal("ran", L.NewTable())
+
+		luaLock.Lock()
+		err := execute(L, test.target, nil)
+		luaLock.Unlock()
+
+		if test.err != (err != nil) {
+			t.Errorf("%v: expected error %v, got %v", i, test.err, err)
+		}
+		if names := ran(L); !reflect.DeepEqual(names, test.ran) {
+			t.Errorf("%v: expected %v to run, got %v", i, test.ran, names)
+		}
+		if executed[test.target] != !test.err {
+			t.Errorf("%v: expected executed to be %v", i, !test.err)
+		}
+	}
+}
+
+func TestExecuteAbort(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	saved, savedExecuted := subcommands, executed
+	defer func() { subcommands, executed = saved, savedExecuted }()
+
+	executed = make(map[string]bool)
+	subcommands = newGraph(t, L, map[string][]string{"a": nil})
+	if err := L.DoString(`return function() return false end`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subcommands["a"].cmd = L.Get(-1).(*lua.LFunction)
+	L.Pop(1)
+
+	luaLock.Lock()
+	err := execute(L, "a", nil)
+	luaLock.Unlock()
+
+	if err == nil || err.Error() != "user: abort: a" {
+		t.Errorf("expected abort, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// param is a named and typed argument of a target, given as --name=value on
+// the command line
+type param struct {
+	name     string
+	typ      string
+	def      lua.LValue
+	required bool
+	enum     []string
+}
+
+// usage returns the synopsis of the parameter, ie. [--name=<type>]
+func (p *param) usage() string {
+	s := "--" + p.name
+	if p.typ != "bool" {
+		value := "<" + p.typ + ">"
+		if len(p.enum) > 0 {
+			value = "<" + strings.Join(p.enum, "|") + ">"
+		}
+		s = s + "=" + value
+	}
+
+	if !p.required {
+		s = "[" + s + "]"
+	}
+
+	return s
+}
+
+// convert parses a command line value according to the parameter type
+func (p *param) convert(value string) (lua.LValue, error) {
+	if len(p.enum) > 0 && !contains(p.enum, value) {
+		return nil, fmt.Errorf("invalid value for --%v: %v, expected one of: %v", p.name, value, strings.Join(p.enum, ", "))
+	}
+
+	switch p.typ {
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --%v: %v, expected a bool", p.name, value)
+		}
+		return lua.LBool(b), nil
+	case "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --%v: %v, expected a number", p.name, value)
+		}
+		return lua.LNumber(n), nil
+	default:
+		return lua.LString(value), nil
+	}
+}
+
+type params []*param
+
+// get returns the parameter with the name
+func (ps params) get(name string) *param {
+	for _, p := range ps {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// usage returns the synopsis of all parameters
+func (ps params) usage() string {
+	s := make([]string, len(ps))
+	for i, p := range ps {
+		s[i] = p.usage()
+	}
+	return strings.Join(s, " ")
+}
+
+// parse separates --name=value and --name value arguments from positional
+// arguments, and validates them against the schema.
+func (ps params) parse(args []string) (values map[string]lua.LValue, positional []string, err error) {
+	values = make(map[string]lua.LValue)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value := strings.TrimPrefix(arg, "--"), ""
+		hasValue := false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+
+		p := ps.get(name)
+		if p == nil {
+			return nil, nil, fmt.Errorf("unknown option: --%v", name)
+		}
+
+		if !hasValue {
+			if p.typ == "bool" {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				return nil, nil, fmt.Errorf("missing value for --%v", name)
+			}
+		}
+
+		if values[name], err = p.convert(value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, p := range ps {
+		if _, ok := values[p.name]; ok {
+			continue
+		}
+		if p.required {
+			return nil, nil, fmt.Errorf("missing required option: --%v", p.name)
+		}
+		if p.def != lua.LNil {
+			values[p.name] = p.def
+		}
+	}
+
+	return values, positional, nil
+}
+
+// arguments converts command line arguments to the Lua arguments of the
+// target. Targets with parameters get a table with the parameters followed by
+// the positional arguments.
+func (t *target) arguments(L *lua.LState, args []string) ([]lua.LValue, error) {
+	if len(t.params) == 0 {
+		return lvStrings(args), nil
+	}
+
+	values, positional, err := t.params.parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl := L.NewTable()
+	for name, value := range values {
+		tbl.RawSetString(name, value)
+	}
+
+	return append([]lua.LValue{tbl}, lvStrings(positional)...), nil
+}
+
+// validateArgs checks the arguments of a target and exits with a usage error
+// if they are not valid.
+func validateArgs(name string, args []string) {
+	subcmd, ok := subcommands[name]
+	if !ok || len(subcmd.params) == 0 {
+		return
+	}
+
+	if _, _, err := subcmd.params.parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "usage: blade %v %v\n", name, subcmd.params.usage())
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		exit(2)
+	}
+}
+
+// paramCompgen completes parameter names, and values of parameters with
+// enums
+type paramCompgen struct {
+	params params
+}
+
+func (pc *paramCompgen) compgen(L *lua.LState, compWords []string, compCWords int) *completion {
+	word := func(i int) string {
+		if i >= 0 && i < len(compWords) {
+			return compWords[i]
+		}
+		return ""
+	}
+
+	// the value of --name=value is completed with the name when the word is
+	// not split, otherwise bash splits it into three words
+	if cur := word(compCWords); strings.HasPrefix(cur, "--") && strings.Contains(cur, "=") {
+		name := cur[2:strings.Index(cur, "=")]
+		c := &completion{}
+		if p := pc.params.get(name); p != nil && p.typ != "bool" {
+			for _, value := range p.enum {
+				c.candidates = append(c.candidates, candidate{value: "--" + name + "=" + value})
+			}
+		}
+		return c
+	}
+
+	prev := word(compCWords - 1)
+	if prev == "=" {
+		prev = word(compCWords - 2)
+	}
+
+	if p := pc.params.get(strings.TrimPrefix(prev, "--")); p != nil && strings.HasPrefix(prev, "--") && p.typ != "bool" {
+		return words(strings.Join(p.enum, " "))
+	}
+
+	c := &completion{}
+	for _, p := range pc.params {
+		c.candidates = append(c.candidates, candidate{value: "--" + p.name, description: p.usage()})
+	}
+	return c
+}
+
+// contains checks if s is in the list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var testParams = params{
+	{name: "dev", typ: "bool", def: lua.LFalse},
+	{name: "count", typ: "number", def: lua.LNumber(1)},
+	{name: "env", typ: "string", def: lua.LNil, enum: []string{"staging", "prod"}},
+	{name: "name", typ: "string", def: lua.LNil},
+}
+
+func TestParamsParse(t *testing.T) {
+	tests := []struct {
+		args       []string
+		values     map[string]lua.LValue
+		positional []string
+	}{
+		{
+			args:   nil,
+			values: map[string]lua.LValue{"dev": lua.LFalse, "count": lua.LNumber(1)},
+		},
+		{
+			args:   []string{"--dev", "--count=3", "--env", "prod", "--name=x"},
+			values: map[string]lua.LValue{"dev": lua.LTrue, "count": lua.LNumber(3), "env": lua.LString("prod"), "name": lua.LString("x")},
+		},
+		{
+			args:   []string{"--dev=false", "--count", "2.5"},
+			values: map[string]lua.LValue{"dev": lua.LFalse, "count": lua.LNumber(2.5)},
+		},
+		{
+			args:       []string{"a", "--name=--x", "b"},
+			values:     map[string]lua.LValue{"dev": lua.LFalse, "count": lua.LNumber(1), "name": lua.LString("--x")},
+			positional: []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		values, positional, err := testParams.parse(test.args)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%v: expected values %v, got %v", test.args, test.values, values)
+		}
+		if !reflect.DeepEqual(positional, test.positional) {
+			t.Errorf("%v: expected positional %v, got %v", test.args, test.positional, positional)
+		}
+	}
+}
+
+func TestParamsParseErrors(t *testing.T) {
+	required := append(params{{name: "version", typ: "string", def: lua.LNil, required: true}}, testParams...)
+
+	tests := []struct {
+		params params
+		args   []string
+		err    string
+	}{
+		{testParams, []string{"--unknown"}, "unknown option: --unknown"},
+		{testParams, []string{"--count=many"}, "invalid value for --count: many, expected a number"},
+		{testParams, []string{"--dev=maybe"}, "invalid value for --dev: maybe, expected a bool"},
+		{testParams, []string{"--env=dev"}, "invalid value for --env: dev, expected one of: staging, prod"},
+		{testParams, []string{"--name"}, "missing value for --name"},
+		{required, []string{"--dev"}, "missing required option: --version"},
+	}
+
+	for _, test := range tests {
+		_, _, err := test.params.parse(test.args)
+		if err == nil {
+			t.Errorf("%v: expected error %q", test.args, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%v: expected error %q, got %q", test.args, test.err, err)
+		}
+	}
+}
+
+func TestParamUsage(t *testing.T) {
+	tests := []struct {
+		param *param
+		usage string
+	}{
+		{&param{name: "dev", typ: "bool"}, "[--dev]"},
+		{&param{name: "count", typ: "number"}, "[--count=<number>]"},
+		{&param{name: "env", typ: "string", enum: []string{"staging", "prod"}, required: true}, "--env=<staging|prod>"},
+	}
+
+	for _, test := range tests {
+		if usage := test.param.usage(); usage != test.usage {
+			t.Errorf("%v: expected %v, got %v", test.param.name, test.usage, usage)
+		}
+	}
+}
+
+func TestParamCompgen(t *testing.T) {
+	tests := []struct {
+		words  []string
+		values []string
+	}{
+		{[]string{"deploy", ""}, []string{"--dev", "--count", "--env", "--name"}},
+		{[]string{"deploy", "--env", ""}, []string{"staging", "prod"}},
+		// bash splits --env=value into three words
+		{[]string{"deploy", "--env", "=", ""}, []string{"staging", "prod"}},
+		{[]string{"deploy", "--env", "=", "st"}, []string{"staging", "prod"}},
+		// the word is not split without bash-completion, and in zsh and fish
+		{[]string{"deploy", "--env="}, []string{"--env=staging", "--env=prod"}},
+		{[]string{"deploy", "--env=st"}, []string{"--env=staging", "--env=prod"}},
+		{[]string{"deploy", "--name=x"}, nil},
+		{[]string{"deploy", "--unknown=x"}, nil},
+	}
+
+	pc := &paramCompgen{params: testParams}
+	for _, test := range tests {
+		var values []string
+		for _, c := range pc.compgen(nil, test.words, len(test.words)-1).candidates {
+			values = append(values, c.value)
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%q: expected %v, got %v", test.words, test.values, values)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package parser
+
+import "strings"
+
+// Doc is the documentation of a target, parsed from the comment above the
+// target function.
+//
+// The first line is a summary, optionally prefixed with the usage of the
+// target and " - ". The following lines are the description, and lines
+// starting with a tag adds metadata:
+//
+//	--<version> [name] - create a release
+//	--
+//	-- Cross compiles blade and uploads the binaries to Github.
+//	--
+//	-- @param version the version, on the form vX.X.X
+//	-- @param name the name of the release
+//	-- @example blade release v1.0.0
+//	-- @hidden
+type Doc struct {
+	Usage       string
+	Summary     string
+	Description string
+	Params      []Param
+	Examples    []string
+	Hidden      bool
+}
+
+// Param is a documented target parameter
+type Param struct {
+	Name        string
+	Description string
+}
+
+// Short returns the first line of the documentation, ie. usage and summary
+func (d *Doc) Short() string {
+	if d.Usage == "" {
+		return d.Summary
+	}
+	if d.Summary == "" {
+		return d.Usage
+	}
+	return d.Usage + " - " + d.Summary
+}
+
+// Param returns the documented parameter with the name
+func (d *Doc) Param(name string) (Param, bool) {
+	for _, p := range d.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// ParseDoc parses the text of a comment into a Doc
+func ParseDoc(comment string) *Doc {
+	doc := &Doc{}
+
+	var description []string
+	var example *string
+	first := true
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(line)
+
+		if !strings.HasPrefix(line, "@") {
+			switch {
+			case first && line == "":
+				continue
+			case first:
+				first = false
+				doc.Usage, doc.Summary = splitSummary(line)
+			case example != nil && line != "":
+				*example = *example + "\n" + line
+			default:
+				example = nil
+				description = append(description, line)
+			}
+			continue
+		}
+
+		first = false
+		example = nil
+		tag, value := splitTag(line)
+		switch tag {
+		case "@param":
+			name, desc := splitTag(value)
+			doc.Params = append(doc.Params, Param{Name: name, Description: desc})
+		case "@example":
+			doc.Examples = append(doc.Examples, value)
+			example = &doc.Examples[len(doc.Examples)-1]
+		case "@hidden":
+			doc.Hidden = true
+		case "@usage":
+			doc.Usage = value
+		default:
+			description = append(description, line)
+		}
+	}
+
+	doc.Description = strings.Trim(strings.Join(description, "\n"), "\n")
+	return doc
+}
+
+// splitSummary splits the first line of a comment into usage and summary
+func splitSummary(line string) (usage, summary string) {
+	if i := strings.Index(line, " - "); i >= 0 {
+		return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+3:])
+	}
+	return "", line
+}
+
+// splitTag splits a string on the first whitespace
+func splitTag(line string) (string, string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
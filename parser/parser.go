@@ -24,7 +24,11 @@ func (c Comments) Get(row int) (*Comment, error) {
 		if c[i].Row != row {
 			continue
 		}
-		result.Value = result.Value + c[i].Value
+		if result.Value != "" {
+			result.Value = c[i].Value + "\n" + result.Value
+		} else {
+			result.Value = c[i].Value
+		}
 		row--
 	}
 
@@ -25,3 +25,64 @@ var test  = 32
 	fmt.Printf("R: 7 == %v, Comment 1 = %v\n", comments[2].Row, comments[2].Value)
 	fmt.Printf("R: 11 == %v, Comment 1 = %v\n", comments[3].Row, comments[3].Value)
 }
+
+func TestGetMultiLine(t *testing.T) {
+	s := `
+--first
+--second
+function test
+`
+	comment, err := String(s).Get(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "first\nsecond"
+	if comment.Value != expected {
+		t.Errorf("expected: `%v`, got: `%v`", expected, comment.Value)
+	}
+}
+
+func TestParseDoc(t *testing.T) {
+	s := `<version> [name] - create a release
+
+ Cross compiles and uploads
+ the binaries.
+
+ @param version the version, vX.X.X
+ @param name
+ @example blade release v1.0.0
+   blade release v1.0.1 next
+ @hidden`
+
+	doc := ParseDoc(s)
+
+	if doc.Usage != "<version> [name]" {
+		t.Errorf("usage: got `%v`", doc.Usage)
+	}
+	if doc.Summary != "create a release" {
+		t.Errorf("summary: got `%v`", doc.Summary)
+	}
+	if doc.Description != "Cross compiles and uploads\nthe binaries." {
+		t.Errorf("description: got `%v`", doc.Description)
+	}
+	if len(doc.Params) != 2 || doc.Params[0].Name != "version" || doc.Params[0].Description != "the version, vX.X.X" || doc.Params[1].Name != "name" {
+		t.Errorf("params: got %+v", doc.Params)
+	}
+	if len(doc.Examples) != 1 || doc.Examples[0] != "blade release v1.0.0\nblade release v1.0.1 next" {
+		t.Errorf("examples: got %q", doc.Examples)
+	}
+	if !doc.Hidden {
+		t.Errorf("hidden: expected true")
+	}
+	if doc.Short() != "<version> [name] - create a release" {
+		t.Errorf("short: got `%v`", doc.Short())
+	}
+}
+
+func TestParseDocSummary(t *testing.T) {
+	doc := ParseDoc("clean working directory of builds")
+	if doc.Usage != "" || doc.Summary != "clean working directory of builds" || doc.Hidden {
+		t.Errorf("got %+v", doc)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// defaultPollInterval is the interval between scans of the poll backend
+const defaultPollInterval = time.Second
+
+// backend reports the file events of the watched files and directories, like
+// fsnotify a watched directory reports the events of the files in it
+type backend interface {
+	Add(name string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// fsnotifyBackend is the default backend, using the events of the OS
+type fsnotifyBackend struct {
+	w *fsnotify.Watcher
+
+	// names are the watched files, they are added to the poll backend when
+	// falling back to it
+	names []string
+}
+
+func newFsnotifyBackend() (*fsnotifyBackend, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyBackend{w: w}, nil
+}
+
+func (b *fsnotifyBackend) Add(name string) error {
+	if err := b.w.Add(name); err != nil {
+		return err
+	}
+	b.names = append(b.names, name)
+	return nil
+}
+
+func (b *fsnotifyBackend) Events() <-chan fsnotify.Event { return b.w.Events }
+func (b *fsnotifyBackend) Errors() <-chan error          { return b.w.Errors }
+func (b *fsnotifyBackend) Close() error                  { return b.w.Close() }
+
+// watchLimit checks if adding a watch failed since the OS limit of watches is
+// reached, for instance fs.inotify.max_user_watches on Linux
+func watchLimit(err error) bool {
+	return err == syscall.ENOSPC
+}
+
+// fileState is the state of a file compared by the poll backend
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// pollBackend scans the modification times and sizes of the watched files at
+// an interval. It works on file systems without file events, like network
+// file systems and some bind mounts, but a rename is reported as a remove of
+// the old name and a create of the new name.
+type pollBackend struct {
+	mu      sync.Mutex
+	watches map[string]map[string]fileState
+
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+}
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	b := &pollBackend{
+		watches: make(map[string]map[string]fileState),
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	go b.poll(interval)
+	return b
+}
+
+// Add watches the file, or the files in the directory
+func (b *pollBackend) Add(name string) error {
+	files, err := scan(name)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watches[filepath.Clean(name)] = files
+	return nil
+}
+
+func (b *pollBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *pollBackend) Errors() <-chan error          { return b.errors }
+
+func (b *pollBackend) Close() error {
+	close(b.done)
+	return nil
+}
+
+func (b *pollBackend) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, event := range b.changes() {
+				select {
+				case b.events <- event:
+				case <-b.done:
+					return
+				}
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// changes scans the watched files and returns the events since the last scan.
+// A watched file or directory that is gone is no longer watched.
+func (b *pollBackend) changes() []fsnotify.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var events []fsnotify.Event
+	for name, old := range b.watches {
+		files, err := scan(name)
+		if err != nil {
+			emit("poll: %v", err)
+			delete(b.watches, name)
+		} else {
+			b.watches[name] = files
+		}
+		events = append(events, diff(old, files)...)
+	}
+
+	sort.Sort(byEventName(events))
+	return events
+}
+
+// scan returns the state of the file, or of the files in the directory
+func scan(name string) (map[string]fileState, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]fileState)
+	if !fi.IsDir() {
+		files[name] = fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+		return files, nil
+	}
+
+	entries, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		files[filepath.Join(name, fi.Name())] = fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+	}
+	return files, nil
+}
+
+// diff returns the events between two scans
+func diff(old, files map[string]fileState) []fsnotify.Event {
+	var events []fsnotify.Event
+	for name, state := range files {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Create})
+		case state.mode.IsDir() && state.mode == prev.mode:
+			// the files of a directory are reported by its own watch
+		case !state.modTime.Equal(prev.modTime) || state.size != prev.size:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Write})
+		case state.mode != prev.mode:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Chmod})
+		}
+	}
+
+	for name := range old {
+		if _, ok := files[name]; !ok {
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+		}
+	}
+
+	return events
+}
+
+type byEventName []fsnotify.Event
+
+func (e byEventName) Len() int           { return len(e) }
+func (e byEventName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byEventName) Less(i, j int) bool { return e[i].Name < e[j].Name }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Second)
+
+	old := map[string]fileState{
+		"same":    {modTime: now, size: 1, mode: 0644},
+		"touched": {modTime: now, size: 1, mode: 0644},
+		"grown":   {modTime: now, size: 1, mode: 0644},
+		"chmod":   {modTime: now, size: 1, mode: 0644},
+		"removed": {modTime: now, size: 1, mode: 0644},
+		"dir":     {modTime: now, mode: os.ModeDir | 0755},
+	}
+	files := map[string]fileState{
+		"same":    {modTime: now, size: 1, mode: 0644},
+		"touched": {modTime: later, size: 1, mode: 0644},
+		"grown":   {modTime: now, size: 2, mode: 0644},
+		"chmod":   {modTime: now, size: 1, mode: 0755},
+		"created": {modTime: now, size: 1, mode: 0644},
+		"dir":     {modTime: later, mode: os.ModeDir | 0755},
+	}
+
+	events := diff(old, files)
+	sort.Sort(byEventName(events))
+
+	expected := []fsnotify.Event{
+		{Name: "chmod", Op: fsnotify.Chmod},
+		{Name: "created", Op: fsnotify.Create},
+		{Name: "grown", Op: fsnotify.Write},
+		{Name: "removed", Op: fsnotify.Remove},
+		{Name: "touched", Op: fsnotify.Write},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+
+	if events := diff(files, files); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestPollChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(a, []byte("a"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the scans are done by calling changes, not by the interval
+	p := newPollBackend(time.Hour)
+	defer p.Close()
+
+	if err := p.Add(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.Add(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error watching a missing file")
+	}
+
+	if events := p.changes(); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+
+	if err := ioutil.WriteFile(a, []byte("aa"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(b, []byte("b"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []fsnotify.Event{{Name: a, Op: fsnotify.Write}, {Name: b, Op: fsnotify.Create}}
+	if events := p.changes(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []fsnotify.Event{{Name: a, Op: fsnotify.Remove}}
+	if events := p.changes(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+
+	// a removed directory is no longer watched
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []fsnotify.Event{{Name: b, Op: fsnotify.Remove}}
+	if events := p.changes(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v, got %v", expected, events)
+	}
+	if len(p.watches) != 0 {
+		t.Errorf("expected no watches, got %v", p.watches)
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/otm/blade/luasrc"
+	"github.com/otm/blade/parser"
 	"github.com/yuin/gopher-lua"
 )
 
@@ -29,12 +31,16 @@ var (
 
 	// done is used for signaling that we should abort the blade target execution
 	// and quit
-	done chan struct{}
+	done   chan struct{}
+	doneMu sync.Mutex
 
-	// currentTarget is the name of the curret running target
-	// This is used when generating error messages for fatal errors when running
-	// targets.
-	currentTarget string
+	// invocationDir is the directory blade was started in, or the directory of
+	// the -C flag
+	invocationDir string
+
+	// executed contains the targets that has been run in this invocation, it
+	// makes sure prerequisites are only run once
+	executed = make(map[string]bool)
 
 	errAbort           = errors.New("user: abort")
 	errUndefinedTarget = errors.New("fatal: undefined target")
@@ -44,6 +50,17 @@ type target struct {
 	cmd     *lua.LFunction
 	help    string
 	compgen compgenerator
+	deps    []*lua.LFunction
+	sources []string
+	outputs []string
+	params  params
+	doc     *parser.Doc
+	file    string
+	line    int
+	dir     string
+	workdir string
+	global  bool
+	dynamic bool
 	valid   bool
 }
 
@@ -62,6 +79,15 @@ func (t targets) get(fn *lua.LFunction) (subcmd *target, name string) {
 	return subcmd, name
 }
 
+// drop removes the target bound to fn
+func (t targets) drop(fn *lua.LFunction) {
+	for name, subcmd := range t {
+		if subcmd.cmd == fn {
+			delete(t, name)
+		}
+	}
+}
+
 func (t targets) rename(from, to string) error {
 	if _, ok := t[from]; !ok {
 		return fmt.Errorf("Target not found: %v", from)
@@ -73,6 +99,11 @@ func (t targets) rename(from, to string) error {
 	return nil
 }
 
+// hidden checks if the target is documented with @hidden
+func (t *target) hidden() bool {
+	return t.doc != nil && t.doc.Hidden
+}
+
 func (t targets) validate() {
 	for _, subcmd := range t {
 		if !subcmd.valid {
@@ -80,7 +111,7 @@ func (t targets) validate() {
 			fmt.Fprintf(os.Stderr, "fatal: check blade.help and blade.compgen calls\n")
 			fmt.Fprintf(os.Stderr, "debug: the following functions are ok:\n")
 			t.printValidTargets()
-			os.Exit(1)
+			exit(1)
 		}
 	}
 }
@@ -96,10 +127,26 @@ func (t targets) printValidTargets() {
 type flags struct {
 	debug       bool
 	genBashConf bool
+	genZshConf  bool
+	genFishConf bool
 	compgen     bool
 	init        bool
 	compCWords  int
+	compLines   bool
+	compRefresh bool
 	bladefile   string
+	dir         string
+	jobs        int
+	force       bool
+	checksum    bool
+	cacheClean  bool
+	targets     string
+	list        bool
+	all         bool
+	allow       bool
+	deny        bool
+	safe        bool
+	format      string
 }
 
 func init() {
@@ -107,9 +154,26 @@ func init() {
 	flag.BoolVar(&flg.debug, "debug", false, "Enable debug output")
 	flag.BoolVar(&flg.compgen, "compgen", false, "Used for bash compleation")
 	flag.BoolVar(&flg.genBashConf, "generate-bash-conf", false, "Generate bash completion configuration")
+	flag.BoolVar(&flg.genZshConf, "generate-zsh-conf", false, "Generate zsh completion configuration")
+	flag.BoolVar(&flg.genFishConf, "generate-fish-conf", false, "Generate fish completion configuration")
 	flag.IntVar(&flg.compCWords, "comp-cwords", 0, "Used for bash compleation")
+	flag.BoolVar(&flg.compRefresh, "compgen-refresh", false, "Refresh cached completions")
+	flag.BoolVar(&flg.compLines, "comp-lines", false, "Used for shell completion, output one candidate per line")
 	flag.StringVar(&flg.bladefile, "f", "", "Absolute path to non default blade file")
+	flag.StringVar(&flg.dir, "C", "", "Change to dir before looking for the blade file")
 	flag.BoolVar(&flg.init, "init", false, "Create a Bladefilein the current directory")
+	flag.BoolVar(&flg.list, "list", false, "List all targets")
+	flag.BoolVar(&flg.all, "all", false, "Run the target in every project under the repository root that defines it")
+	flag.StringVar(&flg.format, "format", "plain", "Output format of -list: plain or json")
+	flag.StringVar(&flg.targets, "t", "", "Comma separated list of targets to run")
+	flag.IntVar(&flg.jobs, "j", 1, "Number of independent targets to run concurrently")
+	flag.BoolVar(&flg.force, "B", false, "Run targets even if they are up to date")
+	flag.BoolVar(&flg.force, "force", false, "Run targets even if they are up to date")
+	flag.BoolVar(&flg.checksum, "checksum", false, "Use content checksums instead of timestamps to find up to date targets")
+	flag.BoolVar(&flg.cacheClean, "cache-clean", false, "Remove the state stored in the .blade directory")
+	flag.BoolVar(&flg.allow, "allow", false, "Trust the blade file, or the files given as arguments, to be run")
+	flag.BoolVar(&flg.safe, "safe", false, "Run the blade file without side effects, they are reported instead")
+	flag.BoolVar(&flg.deny, "deny", false, "Remove the blade file, or the files given as arguments, from the trusted files")
 }
 
 // setupInterupt is used for catching ctrl-c when we want to abort the current
@@ -121,6 +185,8 @@ func setupInterupt() {
 	go func() {
 		sig := <-c
 		emit("Received: %v", sig)
+		doneMu.Lock()
+		defer doneMu.Unlock()
 		if done != nil {
 			emit("Signaling shutdown")
 			close(done)
@@ -145,62 +211,193 @@ func writeFile() {
 	if err != nil {
 		emitFatal("Could not write configuration: %v", err)
 	}
+
+	if err := allow(absPath(file)); err != nil {
+		emitFatal("Could not trust configuration: %v", err)
+	}
 }
 
 func main() {
 	flag.Parse()
 
+	if flg.jobs < 1 {
+		flg.jobs = 1
+	}
+
+	if flg.dir != "" {
+		if err := os.Chdir(flg.dir); err != nil {
+			emitFatal("fatal: %v\n", err)
+		}
+	}
+
+	invocationDir = absPath(".")
+
+	defer reportSideEffects()
+
+	// the main goroutine owns the Lua state, see luaLock
+	luaLock.Lock()
+
 	if flg.genBashConf {
 		generateBashConfig()
 		return
 	}
 
+	if flg.genZshConf {
+		generateZshConfig()
+		return
+	}
+
+	if flg.genFishConf {
+		generateFishConfig()
+		return
+	}
+
 	if flg.init {
 		writeFile()
 		return
 	}
 
+	if flg.allow {
+		if err := allow(trustFiles(flag.Args())...); err != nil {
+			emitFatal("fatal: %v\n", err)
+		}
+		return
+	}
+
+	if flg.deny {
+		if err := deny(trustFiles(flag.Args())...); err != nil {
+			emitFatal("fatal: %v\n", err)
+		}
+		return
+	}
+
 	if flg.compgen {
 		compgen()
 		return
 	}
 
+	if flg.cacheClean {
+		cleanCache(absPath(findBladefile(flg.bladefile)))
+		return
+	}
+
+	if flg.list {
+		if !restoreSnapshot() {
+			setupEnv()
+		}
+		printList(flg.format)
+		return
+	}
+
+	if flg.all {
+		exit(runAll(flag.Args()))
+	}
+
 	setupInterupt()
 
 	L, blade, cmd := setupEnv()
 
 	if flag.Arg(0) == "help" {
+		if flag.NArg() > 1 {
+			printTargetHelp(flag.Arg(1))
+			return
+		}
 		printHelp(L)
 		return
 	}
 
-	target := flag.Arg(0)
-
-	err := setup(L, blade, target)
+	calls, err := invocations(flg.targets, flag.Args())
 	if err != nil {
-		emitErr("%v: setup", err)
-		return
+		fmt.Fprintf(os.Stderr, "usage: blade [OPTION] <target> [<args>] [-- <target> [<args>]]...\n")
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		exit(2)
 	}
-	defer teardown(L, blade, target)
 
-	if flag.NArg() == 0 {
-		defaultTarget(L, blade)
-		return
+	names := make([]string, len(calls))
+	for i, call := range calls {
+		names[i] = call.target
+	}
+	if len(names) == 0 {
+		names = []string{""}
 	}
 
-	if flag.NArg() > 0 {
-		err := lookupLFunc(L, cmd, target)
+	for _, call := range calls {
+		err := lookupTarget(call.target)
 		if err != nil {
-			emitFatal("%v", err)
+			emitFatal("%v: %v\n", err, call.target)
 		}
+		validateArgs(call.target, call.args)
+	}
+
+	err = setup(L, blade, names...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: setup\n", err)
+		exit(1)
+	}
+
+	if len(calls) == 0 {
+		err = defaultTarget(L, blade)
+	}
+	for _, call := range calls {
+		if err = customTarget(L, cmd, call.target, call.args); err != nil {
+			break
+		}
+	}
 
-		customTarget(L, cmd, target, flag.Args()[1:])
+	// teardown is run even if a target fails
+	status := 0
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		status = 1
+	} else {
 		wait(done)
-		return
 	}
+	if err := teardown(L, blade, names...); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: teardown\n", err)
+		status = 1
+	}
+	exit(status)
+}
+
+// invocation is a target to run together with its arguments
+type invocation struct {
+	target string
+	args   []string
+}
+
+// invocations returns the targets to run. The comma separated list from the
+// -t flag are run first without arguments, followed by the targets on the
+// command line, where "--" separates a target and its arguments from the next.
+// It is an error if there is no target between two separators.
+func invocations(list string, args []string) ([]invocation, error) {
+	var calls []invocation
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			calls = append(calls, invocation{target: target})
+		}
+	}
+
+	for len(args) > 0 {
+		if args[0] == "--" {
+			return nil, errors.New("missing target between separators: --")
+		}
+
+		call := invocation{target: args[0]}
+		args = args[1:]
+		for len(args) > 0 && args[0] != "--" {
+			call.args = append(call.args, args[0])
+			args = args[1:]
+		}
+		args = shift(args)
+		calls = append(calls, call)
+	}
+
+	return calls, nil
 }
 
 func pause() {
+	doneMu.Lock()
+	defer doneMu.Unlock()
 	if done != nil {
 		return
 	}
@@ -209,6 +406,8 @@ func pause() {
 	done = make(chan struct{})
 }
 
+// wait runs the event loop until ch is closed, or there are no watchers or
+// timers left
 func wait(ch chan struct{}) {
 	if ch == nil {
 		return
@@ -216,15 +415,20 @@ func wait(ch chan struct{}) {
 
 	emit("Waiting for done signal")
 	fmt.Printf("watching: ctrl-c to abort\n")
-	for {
-		select {
-		case <-ch:
-			emit("Done waiting")
-			return
-		default:
-			time.Sleep(10 * time.Millisecond)
+	for activeSources() > 0 {
+		var ev event
+		unlocked(func() {
+			select {
+			case ev = <-events:
+			case <-ch:
+			}
+		})
+		if ev == nil {
+			break
 		}
+		ev()
 	}
+	emit("Done waiting")
 }
 
 func emit(msgfmt string, args ...interface{}) {
@@ -240,5 +444,13 @@ func emitErr(msgfmt string, args ...interface{}) {
 
 func emitFatal(msgfmt string, args ...interface{}) {
 	fmt.Fprintf(os.Stdout, msgfmt, args...)
-	os.Exit(1)
+	exit(1)
+}
+
+// exit reports the side effects blocked in safe mode and exits with the
+// status. Deferred functions are not run by os.Exit, so blade always exits
+// through exit.
+func exit(code int) {
+	reportSideEffects()
+	os.Exit(code)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInvocations(t *testing.T) {
+	tests := []struct {
+		list  string
+		args  []string
+		calls []invocation
+	}{
+		{
+			calls: nil,
+		},
+		{
+			args:  []string{"a"},
+			calls: []invocation{{target: "a"}},
+		},
+		{
+			args:  []string{"a", "x", "y"},
+			calls: []invocation{{target: "a", args: []string{"x", "y"}}},
+		},
+		{
+			args:  []string{"a", "x", "--", "b", "--", "c", "y"},
+			calls: []invocation{{target: "a", args: []string{"x"}}, {target: "b"}, {target: "c", args: []string{"y"}}},
+		},
+		{
+			args:  []string{"a", "--"},
+			calls: []invocation{{target: "a"}},
+		},
+		{
+			list:  "a, b,",
+			args:  []string{"c", "x"},
+			calls: []invocation{{target: "a"}, {target: "b"}, {target: "c", args: []string{"x"}}},
+		},
+	}
+
+	for _, test := range tests {
+		calls, err := invocations(test.list, test.args)
+		if err != nil {
+			t.Errorf("%q %v: unexpected error: %v", test.list, test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%q %v: expected %v, got %v", test.list, test.args, test.calls, calls)
+		}
+	}
+}
+
+func TestInvocationsEmptyTarget(t *testing.T) {
+	for _, args := range [][]string{
+		{"a", "--", "--", "b"},
+		{"--", "a"},
+		{"a", "--", "b", "--", "--"},
+	} {
+		if calls, err := invocations("", args); err == nil {
+			t.Errorf("%v: expected error, got %v", args, calls)
+		}
+	}
+}
+
+func TestTeardownOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bladefile := `
+function blade.setup() print("setup") end
+function blade.teardown() print("teardown") end
+function target.a() print("ran a") end
+function target.b() blade.sh("false") end
+function target.c() print("ran c") end
+function target.d() error("failed d") end
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "Bladefile"), []byte(bladefile), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out, err := blade(dir, "-allow"); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	tests := []struct {
+		args    []string
+		ran     []string
+		skipped []string
+	}{
+		{args: []string{"a", "--", "b", "--", "c"}, ran: []string{"ran a"}, skipped: []string{"ran c"}},
+		{args: []string{"-t", "a,d,c"}, ran: []string{"ran a", "failed d"}, skipped: []string{"ran c"}},
+	}
+
+	for _, test := range tests {
+		out, err := blade(dir, test.args...)
+		if err == nil {
+			t.Errorf("%v: expected failure\n%v", test.args, out)
+		}
+
+		for _, s := range append(test.ran, "setup", "teardown") {
+			if strings.Count(out, s) != 1 {
+				t.Errorf("%v: expected %q once, got:\n%v", test.args, s, out)
+			}
+		}
+		for _, s := range test.skipped {
+			if strings.Contains(out, s) {
+				t.Errorf("%v: unexpected %q, got:\n%v", test.args, s, out)
+			}
+		}
+	}
+}
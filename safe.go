@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// sideEffects are the side effects blocked in safe mode, they are reported
+// when blade exits
+var sideEffects []string
+
+// record adds a blocked call of the function with the name, the arguments
+// are taken from the stack starting at from
+func record(L *lua.LState, name string, from int) {
+	var args []string
+	for i := from; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			args = append(args, v.String())
+		}
+	}
+
+	// side effects outside of targets happen when loading the Bladefile
+	target := "load"
+	if jobOf(L) != nil {
+		target = transform(runningTarget(L))
+	}
+
+	sideEffects = append(sideEffects, fmt.Sprintf("[%v] %v %v", target, name, strings.Join(args, " ")))
+}
+
+// blocked returns a Lua function that records the call instead of performing
+// it, and returns the results
+func blocked(name string, results ...lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		record(L, name, 1)
+		for _, result := range results {
+			L.Push(result)
+		}
+		return len(results)
+	}
+}
+
+// sandbox replaces the functions with side effects in the Lua state by
+// functions that record them. Files can be read, but not written.
+func sandbox(L *lua.LState, blade *lua.LTable) {
+	emit("Sandboxing Lua state")
+
+	osLib := L.GetGlobal("os").(*lua.LTable)
+	osLib.RawSetString("execute", L.NewFunction(blocked("os.execute", lua.LNumber(0))))
+	osLib.RawSetString("remove", L.NewFunction(blocked("os.remove", lua.LTrue)))
+	osLib.RawSetString("rename", L.NewFunction(blocked("os.rename", lua.LTrue)))
+	osLib.RawSetString("tmpname", L.NewFunction(blocked("os.tmpname", lua.LString(os.DevNull))))
+
+	file := stubFile(L)
+	ioLib := L.GetGlobal("io").(*lua.LTable)
+	ioLib.RawSetString("popen", L.NewFunction(blocked("io.popen", file)))
+	ioLib.RawSetString("tmpfile", L.NewFunction(blocked("io.tmpfile", file)))
+	ioLib.RawSetString("open", L.NewFunction(safeOpen(ioLib.RawGetString("open"), file)))
+	ioLib.RawSetString("output", L.NewFunction(safeOutput(ioLib.RawGetString("output"))))
+
+	for _, name := range []string{"sh", "_sh", "exec", "_exec", "system"} {
+		blade.RawSetString(name, L.NewFunction(blocked("blade."+name, lua.LNumber(0), lua.LString(""), lua.LString(""))))
+	}
+	blade.RawGetString("plugin").(*lua.LTable).RawSetString("watch", L.NewFunction(blocked("blade.plugin.watch")))
+
+	L.PreloadModule("sh", func(L *lua.LState) int {
+		L.Push(shStub(L, "sh"))
+		return 1
+	})
+}
+
+// safeOpen opens files for reading, opening a file for writing is recorded
+// and returns a file that discards all writes
+func safeOpen(open lua.LValue, file *lua.LTable) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if mode := L.OptString(2, "r"); strings.ContainsAny(mode, "wa+") {
+			record(L, "io.open", 1)
+			L.Push(file)
+			return 1
+		}
+
+		top := L.GetTop()
+		L.Push(open)
+		for i := 1; i <= top; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(top, lua.MultRet)
+		return L.GetTop() - top
+	}
+}
+
+// safeOutput records changes of the default output file
+func safeOutput(output lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if L.GetTop() > 0 {
+			record(L, "io.output", 1)
+		}
+
+		L.Push(output)
+		L.Call(0, 1)
+		return 1
+	}
+}
+
+// stubFile returns a file that is empty and discards writes
+func stubFile(L *lua.LState) *lua.LTable {
+	file := L.NewTable()
+	self := func(L *lua.LState) int {
+		L.Push(file)
+		return 1
+	}
+
+	file.RawSetString("read", L.NewFunction(func(L *lua.LState) int { return 0 }))
+	file.RawSetString("lines", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.NewFunction(func(L *lua.LState) int { return 0 }))
+		return 1
+	}))
+	file.RawSetString("write", L.NewFunction(self))
+	file.RawSetString("flush", L.NewFunction(self))
+	file.RawSetString("setvbuf", L.NewFunction(self))
+	file.RawSetString("seek", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(0))
+		return 1
+	}))
+	file.RawSetString("close", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LTrue)
+		return 1
+	}))
+	return file
+}
+
+// shStub replaces the sh module in safe mode. Calling a command is recorded,
+// and the result is a stub on which any method can be called.
+func shStub(L *lua.LState, name string) *lua.LTable {
+	stub := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		// the module is indexed by command name
+		if name == "sh" {
+			L.Push(shStub(L, "sh."+L.CheckString(2)))
+		} else {
+			L.Push(shResult(L))
+		}
+		return 1
+	}))
+	mt.RawSetString("__call", L.NewFunction(func(L *lua.LState) int {
+		record(L, name, 2)
+		L.Push(shResult(L))
+		return 1
+	}))
+
+	L.SetMetatable(stub, mt)
+	return stub
+}
+
+// shResult is the result of a command in safe mode, methods return empty
+// output and success
+func shResult(L *lua.LState) *lua.LTable {
+	result := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(result)
+			return 1
+		}))
+		return 1
+	}))
+	mt.RawSetString("__call", L.NewFunction(func(L *lua.LState) int {
+		L.Push(result)
+		return 1
+	}))
+	mt.RawSetString("__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(""))
+		return 1
+	}))
+	L.SetMetatable(result, mt)
+	return result
+}
+
+// reportSideEffects prints the side effects blocked in safe mode. With -all
+// each project reports its own side effects.
+func reportSideEffects() {
+	if !flg.safe || flg.all {
+		return
+	}
+
+	if len(sideEffects) == 0 {
+		fmt.Fprintf(os.Stderr, "safe mode: no side effects\n")
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "safe mode: blocked %v side effects:\n", len(sideEffects))
+	for _, effect := range sideEffects {
+		fmt.Fprintf(os.Stderr, "  %v\n", strings.TrimSpace(effect))
+	}
+}
@@ -1,10 +1,33 @@
 package sh
 
-import "github.com/yuin/gopher-lua"
+import (
+	"io"
+	"os"
+
+	"github.com/yuin/gopher-lua"
+)
 
 var exports = map[string]lua.LGFunction{}
 var abort = false
 
+// Stdout returns the writer used when printing command output in the Lua
+// state. It can be replaced by the host to redirect output.
+var Stdout = func(L *lua.LState) io.Writer {
+	return os.Stdout
+}
+
+// Dir returns the working directory of commands started in the Lua state,
+// the empty string is the current directory.
+var Dir = func(L *lua.LState) string {
+	return ""
+}
+
+// Blocking is called with functions that block while waiting on commands. It
+// can be replaced by the host to release resources while waiting.
+var Blocking = func(fn func()) {
+	fn()
+}
+
 // Loader is used for preloading a module
 func Loader(L *lua.LState) int {
 
@@ -50,6 +73,7 @@ func moduleCall(L *lua.LState) int {
 	cmd, err := newShellCommand(path, args...)
 	checkError(L, err)
 
+	cmd.command.Dir = Dir(L)
 	err = cmd.command.Start()
 	checkError(L, err)
 
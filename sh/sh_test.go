@@ -387,3 +387,21 @@ func TestGlobalAbort(t *testing.T) {
 		t.Errorf("expected stdout: `%v`, got: `%v`\nsrc: %v", expected, got, src)
 	}
 }
+
+func TestDir(t *testing.T) {
+	old := Dir
+	Dir = func(L *lua.LState) string { return "/" }
+	defer func() { Dir = old }()
+
+	src := `
+    local sh = require('sh')
+    sh.pwd():print()
+    sh("pwd"):print()
+  `
+	expected := "/\n/"
+	got := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: %v", expected, got, src)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"os"
 	"os/exec"
 	"syscall"
 
@@ -154,6 +153,7 @@ func shCall(L *lua.LState) int {
 	if shellCmd.stdin != nil {
 		shellCmd.command.Stdin = shellCmd.stdin
 	}
+	shellCmd.command.Dir = Dir(L)
 
 	err = shellCmd.command.Start()
 	checkError(L, err)
@@ -282,7 +282,10 @@ func shPrint(L *lua.LState) int {
 
 	combo := io.MultiReader(shellCmd.stdout, shellCmd.stderr)
 
-	_, err := io.Copy(os.Stdout, combo)
+	var err error
+	Blocking(func() {
+		_, err = io.Copy(Stdout(L), combo)
+	})
 	checkError(L, err)
 
 	_, err = wait(L, shellCmd)
@@ -344,7 +347,10 @@ func wait(L *lua.LState, shellCmd *shellCommand) (exitcode int, err error) {
 	}()
 
 	if shellCmd.command.ProcessState == nil {
-		err := shellCmd.command.Wait()
+		var err error
+		Blocking(func() {
+			err = shellCmd.command.Wait()
+		})
 		shellCmd.waitCalled = true
 		if err != nil && !isExitError(err) {
 			return 0, err
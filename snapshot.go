@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/otm/blade/parser"
+	"github.com/yuin/gopher-lua"
+)
+
+// snapshot is the metadata of the targets of a Bladefile. It is stored in the
+// state directory and used to answer completions without running the
+// Bladefile, as long as none of the loaded files has changed.
+type snapshot struct {
+	Path    string            `json:"path"`
+	Files   map[string]string `json:"files"`
+	Targets []snapshotTarget  `json:"targets"`
+}
+
+// snapshotTarget is the metadata of a target
+type snapshotTarget struct {
+	targetInfo
+	Dynamic bool            `json:"dynamic,omitempty"`
+	Params  []snapshotParam `json:"params,omitempty"`
+
+	// CacheTTL is set for completion functions with a cache and the default
+	// key, the cache can then be used without running the Bladefile
+	CacheTTL time.Duration `json:"cacheTTL,omitempty"`
+}
+
+type snapshotTargets []snapshotTarget
+
+func (s snapshotTargets) Len() int           { return len(s) }
+func (s snapshotTargets) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotTargets) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// snapshotParam is a parameter of a target, the default value is stored as
+// the command line value and is nil if the parameter has no default
+type snapshotParam struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Default  *string  `json:"default,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+}
+
+// loadedFiles are the Lua files loaded when setting up the environment, the
+// snapshot is invalid if any of them changes
+var loadedFiles []string
+
+// hashFile returns the sha256 checksum of the content of file
+func hashFile(file string) (string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// snapshotFile returns the path of the snapshot of the Bladefile
+func snapshotFile(bladefile string) string {
+	return filepath.Join(stateDir(bladefile), "metadata.json")
+}
+
+// saveSnapshot stores the metadata of the registered targets, if it has
+// changed since the last save
+func saveSnapshot() {
+	snap := snapshot{Path: bladefile, Files: make(map[string]string)}
+	for _, file := range loadedFiles {
+		hash, err := hashFile(file)
+		if os.IsNotExist(err) {
+			// files that are optional, such as the global Bladefile
+			hash, err = "", nil
+		}
+		if err != nil {
+			emit("Unable to hash %v: %v", file, err)
+			return
+		}
+		snap.Files[absPath(file)] = hash
+	}
+
+	for name, subcmd := range subcommands {
+		target := snapshotTarget{targetInfo: newTargetInfo(name, subcmd)}
+		switch c := subcmd.compgen.(type) {
+		case *funcCompgen:
+			target.Dynamic = true
+		case *cachedCompgen:
+			target.Dynamic = true
+			if c.key == nil {
+				target.CacheTTL = c.ttl
+			}
+		}
+		for _, p := range subcmd.params {
+			sp := snapshotParam{Name: p.name, Type: p.typ, Required: p.required, Enum: p.enum}
+			switch p.def.(type) {
+			case lua.LString, lua.LNumber, lua.LBool:
+				def := p.def.String()
+				sp.Default = &def
+			}
+			target.Params = append(target.Params, sp)
+		}
+		snap.Targets = append(snap.Targets, target)
+	}
+	sort.Sort(snapshotTargets(snap.Targets))
+
+	buf, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		emit("Unable to encode snapshot: %v", err)
+		return
+	}
+
+	file := snapshotFile(bladefile)
+	if old, err := ioutil.ReadFile(file); err == nil && string(old) == string(buf) {
+		return
+	}
+
+	emit("Saving snapshot: %v", file)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		emit("Unable to save snapshot: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file, buf, 0644); err != nil {
+		emit("Unable to save snapshot: %v", err)
+	}
+}
+
+// restoreSnapshot registers the targets from the snapshot of the Bladefile.
+// It returns false if there is no snapshot or any of the files has changed,
+// in that case the Bladefile must be run.
+func restoreSnapshot() bool {
+	file := absPath(findBladefile(flg.bladefile))
+
+	buf, err := ioutil.ReadFile(snapshotFile(file))
+	if err != nil {
+		emit("No snapshot: %v", err)
+		return false
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		emit("Ignoring corrupt snapshot: %v", err)
+		return false
+	}
+
+	if snap.Path != file {
+		emit("Snapshot is for another Bladefile: %v", snap.Path)
+		return false
+	}
+
+	for path, hash := range snap.Files {
+		current, err := hashFile(path)
+		if os.IsNotExist(err) {
+			current, err = "", nil
+		}
+		if err != nil || current != hash {
+			emit("Snapshot is stale: %v changed", path)
+			return false
+		}
+	}
+
+	bladefile = file
+	subcommands = make(targets)
+	for _, t := range snap.Targets {
+		subcmd := &target{
+			help:    t.Help,
+			file:    t.File,
+			line:    t.Line,
+			doc:     &parser.Doc{Hidden: t.Hidden},
+			dynamic: t.Dynamic,
+			global:  t.Global,
+			valid:   true,
+		}
+
+		if t.Compgen != "" {
+			subcmd.compgen = &strCompgen{s: t.Compgen}
+		}
+		if t.CacheTTL > 0 {
+			subcmd.compgen = &cachedCompgen{ttl: t.CacheTTL}
+		}
+
+		for _, p := range t.Params {
+			ps := &param{name: p.Name, typ: p.Type, def: lua.LNil, required: p.Required, enum: p.Enum}
+			if p.Default != nil {
+				if ps.def, err = ps.convert(*p.Default); err != nil {
+					emit("Ignoring snapshot: %v", err)
+					return false
+				}
+			}
+			subcmd.params = append(subcmd.params, ps)
+		}
+
+		subcommands[t.Name] = subcmd
+	}
+
+	emit("Restored %v targets from snapshot", len(snap.Targets))
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestSnapshotParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bladefile := `
+function target.deploy() end
+blade.params(target.deploy, {
+	{name="version", required=true},
+	{name="env", enum={"staging", "prod"}, default="staging"},
+	{name="count", type="number", default=2},
+	{name="dev", type="bool", default=false},
+	{name="name"},
+})
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "Bladefile"), []byte(bladefile), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out, err := blade(dir, "-allow"); err != nil {
+		t.Fatalf("unexpected error: %v\n%v", err, out)
+	}
+
+	// the first completion runs the Bladefile and saves the snapshot, the
+	// second is answered from the snapshot
+	args := []string{"-compgen", "-comp-lines", "-comp-cwords", "2", "blade", "deploy", ""}
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		out, err := blade(dir, args...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n%v", err, out)
+		}
+		outputs = append(outputs, out)
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("expected the snapshot to complete as the Bladefile\n%v\ngot\n%v", outputs[0], outputs[1])
+	}
+	if !strings.Contains(outputs[1], "--version=<string>") || strings.Contains(outputs[1], "[--version") {
+		t.Errorf("expected --version to be required, got:\n%v", outputs[1])
+	}
+
+	saved, savedBladefile, savedFlag := subcommands, bladefile, flg.bladefile
+	defer func() { subcommands, bladefile, flg.bladefile = saved, savedBladefile, savedFlag }()
+	flg.bladefile = filepath.Join(dir, "Bladefile")
+
+	if !restoreSnapshot() {
+		t.Fatalf("expected the snapshot to be restored")
+	}
+
+	expected := params{
+		{name: "version", typ: "string", def: lua.LNil, required: true},
+		{name: "env", typ: "string", def: lua.LString("staging"), enum: []string{"staging", "prod"}},
+		{name: "count", typ: "number", def: lua.LNumber(2)},
+		{name: "dev", typ: "bool", def: lua.LFalse},
+		{name: "name", typ: "string", def: lua.LNil},
+	}
+	if ps := subcommands["deploy"].params; !reflect.DeepEqual(ps, expected) {
+		t.Errorf("expected params %v, got %v", expected, ps)
+	}
+}
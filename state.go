@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/otm/blade/parser"
 	"github.com/otm/blade/sh"
@@ -12,6 +13,9 @@ import (
 // LPrintHelp prints the help message
 var LPrintHelp *lua.LFunction
 
+// bladefile is the absolute path of the loaded Bladefile
+var bladefile string
+
 func setupEnv() (L *lua.LState, runner *lua.LTable, cmd *lua.LTable) {
 	emit("Setting up environment\n")
 	L = lua.NewState()
@@ -34,13 +38,25 @@ func setupEnv() (L *lua.LState, runner *lua.LTable, cmd *lua.LTable) {
 	blade.RawSetString("printStatus", L.NewFunction(printStatus))
 	blade.RawSetString("compgen", L.NewFunction(Compgen))
 	blade.RawSetString("help", L.NewFunction(Help))
+	blade.RawSetString("depends", L.NewFunction(Depends))
+	blade.RawSetString("sources", L.NewFunction(Sources))
+	blade.RawSetString("outputs", L.NewFunction(Outputs))
+	blade.RawSetString("params", L.NewFunction(Params))
+	blade.RawSetString("include", L.NewFunction(Include))
+	blade.RawSetString("workdir", L.NewFunction(Workdir))
+	blade.RawSetString("after", L.NewFunction(After))
+	blade.RawSetString("every", L.NewFunction(Every))
 	blade.RawSetString("setup", L.NewFunction(func(L *lua.LState) int { return 0 }))
 	blade.RawSetString("teardown", L.NewFunction(func(L *lua.LState) int { return 0 }))
 	blade.RawSetString("default", LPrintHelp)
 	blade.RawSetString("plugin", plugin)
 	L.SetGlobal("blade", blade)
+	L.SetGlobal("print", L.NewFunction(Print))
 
 	emit("Preloading module: sh")
+	sh.Stdout = stdoutOf
+	sh.Dir = dirOf
+	sh.Blocking = unlocked
 	L.PreloadModule("sh", sh.Loader)
 
 	emit("Setting up cmd\n")
@@ -51,34 +67,37 @@ func setupEnv() (L *lua.LState, runner *lua.LTable, cmd *lua.LTable) {
 	emit("Decorating string library")
 	decorateStringLib(L)
 
+	if flg.safe {
+		sandbox(L, blade)
+	}
+
 	// Search for Bladerunner file
 	filename := findBladefile(flg.bladefile)
+	bladefile = absPath(filename)
+	loadedFiles = []string{bladefile}
+
+	blade.RawSetString("cwd", lua.LString(invocationDir))
+	blade.RawSetString("dir", lua.LString(filepath.Dir(bladefile)))
+	blade.RawSetString("file", lua.LString(bladefile))
+
+	checkTrust(bladefile)
 
 	emit("Parsing blade file\n")
 	if err := L.DoFile(filename); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 
-	emit("Parsing comments")
-	comments, err := parser.File(filename)
-	if err != nil {
-		emitFatal("%v", err)
-	}
+	global := loadGlobal(L)
 
-	emit("Registring blade targets:\n")
-	cmds.ForEach(func(key, value lua.LValue) {
-		if f, ok := value.(*lua.LFunction); ok {
-			emit(" * %v [target]", key)
-			subcommand, name := subcommands.get(f)
-			subcommands.rename(name, key.String())
-
-			if comment, err := comments.Get(f.Proto.LineDefined - 1); err == nil && subcommand.help == "" {
-				subcommand.help = comment.Value
-			}
+	comments := make(sourceComments)
 
-		}
-	})
+	emit("Registring blade targets:\n")
+	visited := make(map[*lua.LTable]bool)
+	registerTargets(cmds, "", comments, visited, false)
+	if global != nil {
+		registerTargets(global, "", comments, visited, true)
+	}
 
 	// Check if we have a default target defined
 	if blade.RawGetString("default").(*lua.LFunction).Proto != nil {
@@ -86,9 +105,7 @@ func setupEnv() (L *lua.LState, runner *lua.LTable, cmd *lua.LTable) {
 			subcommand, name := subcommands.get(blade.RawGetString("default").(*lua.LFunction))
 			subcommands.rename(name, "")
 
-			if comment, err := comments.Get(subcommand.cmd.Proto.LineDefined - 1); err == nil && subcommand.help == "" {
-				subcommand.help = comment.Value
-			}
+			subcommand.document(comments)
 		}
 		emit("Add default target to subcommands, l: %v", blade.RawGetString("default").(*lua.LFunction).Proto.LineDefined)
 
@@ -97,9 +114,34 @@ func setupEnv() (L *lua.LState, runner *lua.LTable, cmd *lua.LTable) {
 
 	subcommands.validate()
 
+	if err := subcommands.checkCycles(); err != nil {
+		emitFatal("%v\n", err)
+	}
+
+	// the targets of a sandboxed Bladefile may differ
+	if !flg.safe {
+		saveSnapshot()
+	}
+
 	return L, blade, cmds
 }
 
+// document parses the comment above the target function
+func (t *target) document(comments sourceComments) {
+	t.file = absPath(t.cmd.Proto.SourceName)
+	t.line = t.cmd.Proto.LineDefined
+	t.dir = filepath.Dir(t.file)
+
+	t.doc = &parser.Doc{}
+	if comment, err := comments.get(t.cmd.Proto.SourceName).Get(t.cmd.Proto.LineDefined - 1); err == nil {
+		t.doc = parser.ParseDoc(comment.Value)
+	}
+
+	if t.help == "" {
+		t.help = t.doc.Short()
+	}
+}
+
 func findBladefile(filename string) string {
 	files := []string{"Bladerunner", "Bladefile"}
 	if filename != "" {
@@ -124,21 +166,35 @@ func findBladefile(filename string) string {
 			} else {
 				fmt.Printf("fatal: No blade file (or in any parent directory): %v\n", files)
 			}
-			os.Exit(1)
+			exit(1)
 		}
 
 		os.Chdir("..")
 	}
 }
 
+// absPath returns the absolute path of file
+func absPath(file string) string {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		emitFatal("fatal: %v\n", err)
+	}
+	return path
+}
+
 func runLFunc(L *lua.LState, tbl *lua.LTable, fn string, args ...lua.LValue) error {
+	return callLFunc(L, tbl.RawGetString(fn), args...)
+}
+
+// callLFunc calls a Lua function, errors raised by the function are returned,
+// and errAbort if it returns false
+func callLFunc(L *lua.LState, fn lua.LValue, args ...lua.LValue) error {
 	if err := L.CallByParam(lua.P{
-		Fn:      tbl.RawGetString(fn),
+		Fn:      fn,
 		NRet:    1,
 		Protect: true,
 	}, args...); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		return err
 	}
 	res := L.Get(-1)
 	L.Pop(1)
@@ -149,25 +205,37 @@ func runLFunc(L *lua.LState, tbl *lua.LTable, fn string, args ...lua.LValue) err
 	return nil
 }
 
-func setup(L *lua.LState, blade *lua.LTable, target string) error {
+func setup(L *lua.LState, blade *lua.LTable, targets ...string) error {
 	emit("Running blade setup")
-	return runLFunc(L, blade, "setup", lua.LString(target))
+	return runLFunc(L, blade, "setup", lvStrings(targets)...)
 }
 
-func teardown(L *lua.LState, blade *lua.LTable, target string) error {
+func teardown(L *lua.LState, blade *lua.LTable, targets ...string) error {
 	emit("Running blade teardown")
-	return runLFunc(L, blade, "teardown", lua.LString(target))
+	return runLFunc(L, blade, "teardown", lvStrings(targets)...)
+}
+
+// lvStrings converts strings to Lua values
+func lvStrings(strs []string) []lua.LValue {
+	values := make([]lua.LValue, len(strs))
+	for i, str := range strs {
+		values[i] = lua.LString(str)
+	}
+	return values
 }
 
 func defaultTarget(L *lua.LState, blade *lua.LTable) error {
+	if _, ok := subcommands[""]; ok {
+		return execute(L, "", nil)
+	}
+
 	emit("Running default target")
 	return runLFunc(L, blade, "default")
 }
 
-func lookupLFunc(L *lua.LState, tbl *lua.LTable, key string) error {
+func lookupTarget(key string) error {
 	emit("Looking up target: %v", key)
-	value := tbl.RawGetString(key)
-	if value.Type() == lua.LTNil {
+	if _, ok := subcommands[key]; !ok {
 		emit("Unable to find target: %v, aborting...", key)
 		return errUndefinedTarget
 	}
@@ -176,14 +244,5 @@ func lookupLFunc(L *lua.LState, tbl *lua.LTable, key string) error {
 }
 
 func customTarget(L *lua.LState, cmds *lua.LTable, target string, args []string) error {
-	emit("Running target: %v", target)
-	currentTarget = target
-
-	// preparing variables to function
-	var lvArgs []lua.LValue
-	for _, arg := range args {
-		lvArgs = append(lvArgs, lua.LString(arg))
-	}
-
-	return runLFunc(L, cmds, target, lvArgs...)
+	return execute(L, target, args)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// allowList maps the absolute path of trusted Bladefiles to the checksum of
+// their content, a Bladefile is only run if it is unchanged since it was
+// allowed
+type allowList map[string]string
+
+// allowFile returns the path of the allow list
+func allowFile() string {
+	return filepath.Join(configDir(), "allow.json")
+}
+
+// loadAllowList reads the allow list, it is empty if it does not exist
+func loadAllowList() (allowList, error) {
+	list := make(allowList)
+	buf, err := ioutil.ReadFile(allowFile())
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("corrupt allow list: %v: %v", allowFile(), err)
+	}
+	return list, nil
+}
+
+// save writes the allow list
+func (a allowList) save() error {
+	buf, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(configDir(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(allowFile(), buf, 0600)
+}
+
+// trusted checks if the file is allowed and unchanged since. The global
+// Bladefile is always trusted.
+func trusted(file string) (bool, error) {
+	if file == globalBladefile() {
+		return true, nil
+	}
+
+	list, err := loadAllowList()
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	return list[file] == hash, nil
+}
+
+// allow adds the files, with their current content, to the allow list
+func allow(files ...string) error {
+	list, err := loadAllowList()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		hash, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		list[file] = hash
+	}
+
+	return list.save()
+}
+
+// deny removes the files from the allow list
+func deny(files ...string) error {
+	list, err := loadAllowList()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		delete(list, file)
+	}
+
+	return list.save()
+}
+
+// checkTrust exits unless the file is trusted. When running interactively the
+// user is asked to trust a new or changed file. Completion never asks, an
+// untrusted file has no completions.
+func checkTrust(file string) {
+	// safe mode has no side effects
+	if flg.safe {
+		return
+	}
+
+	ok, err := trusted(file)
+	if err != nil {
+		emitFatal("fatal: %v\n", err)
+	}
+	if ok {
+		return
+	}
+
+	if flg.compgen {
+		emit("Untrusted blade file: %v", file)
+		exit(1)
+	}
+
+	// the output of -list is read by programs
+	if flg.list || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "fatal: untrusted blade file: %v, run `blade -allow %v` to trust it\n", file, file)
+		exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "blade: %v is new or has changed, trust it and run it? [y/N] ", file)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+	default:
+		emitFatal("fatal: untrusted blade file: %v\n", file)
+	}
+
+	if err := allow(file); err != nil {
+		emitFatal("fatal: %v\n", err)
+	}
+}
+
+// trustFiles returns the absolute paths of the files given to -allow and
+// -deny, by default the Bladefile
+func trustFiles(args []string) []string {
+	if len(args) == 0 {
+		return []string{absPath(findBladefile(flg.bladefile))}
+	}
+
+	files := make([]string, len(args))
+	for i, arg := range args {
+		files[i] = absPath(arg)
+	}
+	return files
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "Bladefile")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	write(`function target.build() print("built") end`)
+
+	tests := []struct {
+		name   string
+		args   []string
+		change func()
+		ok     bool
+	}{
+		{name: "new", ok: false},
+		{name: "allow", args: []string{"-allow"}, ok: true},
+		{name: "deny", args: []string{"-deny"}, ok: false},
+		{name: "allow again", args: []string{"-allow"}, ok: true},
+		{name: "edit", change: func() {
+			write(`function target.build() print("built"); os.execute("true") end`)
+		}, ok: false},
+		{name: "allow edited", args: []string{"-allow", file}, ok: true},
+	}
+
+	for _, test := range tests {
+		if test.args != nil {
+			if out, err := blade(dir, test.args...); err != nil {
+				t.Fatalf("%v: unexpected error: %v\n%v", test.name, err, out)
+			}
+		}
+		if test.change != nil {
+			test.change()
+		}
+
+		out, err := blade(dir, "build")
+		if test.ok != (err == nil) {
+			t.Errorf("%v: expected ok %v, got %v\n%v", test.name, test.ok, err, out)
+		}
+		if !test.ok && !strings.Contains(out, "untrusted blade file: "+file) {
+			t.Errorf("%v: expected the Bladefile to be refused, got:\n%v", test.name, out)
+		}
+		if strings.Contains(out, "built") != test.ok {
+			t.Errorf("%v: expected the target to run %v, got:\n%v", test.name, test.ok, out)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// check reports if the target can be skipped. In checksum mode the
+// fingerprint to store after a successful run is also returned.
+func (t *target) check(name string, args []string) (ok bool, fingerprint string, err error) {
+	if len(t.sources) == 0 && len(t.outputs) == 0 {
+		return false, "", nil
+	}
+
+	if !flg.checksum {
+		ok, err = t.upToDate()
+		return ok, "", err
+	}
+
+	fingerprint, err = t.fingerprint(name, args)
+	if err != nil {
+		return false, "", err
+	}
+
+	missing, err := t.missingOutputs()
+	if err != nil || missing {
+		return false, fingerprint, err
+	}
+
+	return lookupFingerprint(name) == fingerprint, fingerprint, nil
+}
+
+// missingOutputs checks if any output pattern does not match a file
+func (t *target) missingOutputs() (bool, error) {
+	for _, pattern := range t.outputs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return false, err
+		}
+		if len(matches) == 0 {
+			emit("Output missing: %v", pattern)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// upToDate checks if all outputs of the target are newer than all of its
+// sources. Targets without outputs are never up to date.
+func (t *target) upToDate() (bool, error) {
+	if len(t.outputs) == 0 {
+		return false, nil
+	}
+
+	if missing, err := t.missingOutputs(); err != nil || missing {
+		return false, err
+	}
+
+	outputs, err := glob(t.outputs)
+	if err != nil {
+		return false, err
+	}
+
+	var oldest time.Time
+	for i, output := range outputs {
+		fi, err := os.Stat(output)
+		if err != nil {
+			return false, err
+		}
+
+		if i == 0 || fi.ModTime().Before(oldest) {
+			oldest = fi.ModTime()
+		}
+	}
+
+	sources, err := glob(t.sources)
+	if err != nil {
+		return false, err
+	}
+
+	for _, source := range sources {
+		fi, err := os.Stat(source)
+		if err != nil {
+			return false, err
+		}
+
+		if !fi.ModTime().Before(oldest) {
+			emit("Source changed: %v", source)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// glob expands the patterns into a list of unique file names
+func glob(patterns []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the files in dir, with the modification time offset from
+// now
+func writeFiles(t *testing.T, dir string, files map[string]time.Duration) {
+	for name, offset := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		mtime := time.Now().Add(offset)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]time.Duration{
+		"old.go":   -time.Hour,
+		"other.go": -time.Hour,
+		"new.go":   0,
+		"app":      -time.Minute,
+		"app.sha":  -time.Minute,
+		"stale":    -2 * time.Hour,
+	})
+
+	tests := []struct {
+		sources []string
+		outputs []string
+		ok      bool
+	}{
+		{sources: nil, outputs: nil, ok: false},
+		{sources: []string{"*.go"}, outputs: nil, ok: false},
+		{sources: []string{"old.go", "other.go"}, outputs: []string{"app"}, ok: true},
+		{sources: []string{"old.go", "other.go"}, outputs: []string{"app*"}, ok: true},
+		{sources: []string{"*.go"}, outputs: []string{"app"}, ok: false},
+		{sources: []string{"old.go"}, outputs: []string{"app", "stale"}, ok: false},
+		{sources: []string{"old.go"}, outputs: []string{"app", "missing"}, ok: false},
+		{sources: nil, outputs: []string{"app"}, ok: true},
+	}
+
+	saved := flg.checksum
+	defer func() { flg.checksum = saved }()
+	flg.checksum = false
+
+	for _, test := range tests {
+		tgt := &target{sources: join(dir, test.sources), outputs: join(dir, test.outputs)}
+		ok, fingerprint, err := tgt.check("build", nil)
+		if err != nil {
+			t.Errorf("%v %v: unexpected error: %v", test.sources, test.outputs, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%v %v: expected %v, got %v", test.sources, test.outputs, test.ok, ok)
+		}
+		if fingerprint != "" {
+			t.Errorf("%v %v: unexpected fingerprint without -checksum", test.sources, test.outputs)
+		}
+	}
+}
+
+// join returns the patterns relative to dir
+func join(dir string, patterns []string) []string {
+	var joined []string
+	for _, pattern := range patterns {
+		joined = append(joined, filepath.Join(dir, pattern))
+	}
+	return joined
+}
+
+func TestChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blade")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedChecksum, savedBladefile, savedFingerprints := flg.checksum, bladefile, fingerprints
+	defer func() { flg.checksum, bladefile, fingerprints = savedChecksum, savedBladefile, savedFingerprints }()
+	flg.checksum = true
+	bladefile = filepath.Join(dir, "Bladefile")
+	fingerprints = nil
+
+	writeFiles(t, dir, map[string]time.Duration{"main.go": 0, "app": 0})
+	tgt := &target{sources: join(dir, []string{"*.go"}), outputs: join(dir, []string{"app"})}
+
+	// run runs the target if it is not up to date, it returns true if it ran
+	run := func(args ...string) bool {
+		ok, fingerprint, err := tgt.check("build", args)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			return false
+		}
+		if err := storeFingerprint("build", fingerprint); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return true
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		ran    bool
+	}{
+		{"first run", func() {}, true},
+		{"unchanged", func() {}, false},
+		{"touched source", func() {
+			writeFiles(t, dir, map[string]time.Duration{"main.go": time.Hour})
+		}, false},
+		{"changed source", func() {
+			ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("changed"), 0644)
+		}, true},
+		{"new source", func() {
+			writeFiles(t, dir, map[string]time.Duration{"util.go": -time.Hour})
+		}, true},
+		{"missing output", func() {
+			os.Remove(filepath.Join(dir, "app"))
+		}, true},
+		{"restored output", func() {
+			writeFiles(t, dir, map[string]time.Duration{"app": -time.Hour})
+		}, false},
+		{"reloaded store", func() {
+			fingerprints = nil
+		}, false},
+		{"cache clean", func() {
+			cleanCache(bladefile)
+			fingerprints = nil
+		}, true},
+	}
+
+	for _, step := range steps {
+		step.change()
+		if ran := run(); ran != step.ran {
+			t.Errorf("%v: expected ran %v, got %v", step.name, step.ran, ran)
+		}
+	}
+
+	// the arguments are part of the fingerprint
+	if !run("--dev") {
+		t.Errorf("expected to run with new arguments")
+	}
+	if run("--dev") {
+		t.Errorf("expected not to run with the same arguments")
+	}
+}
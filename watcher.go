@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 
@@ -14,38 +16,131 @@ import (
 
 func watch(L *lua.LState) int {
 	emit("Starting fs watcher setup")
-	w := newWatcher(L.ToTable(1))
+	w := newWatcher(L.ToTable(1), callbackJob(L))
 	w.start(L)
 
 	return 0
 }
 
+// ops are the names of the file operations
+var ops = []struct {
+	op   fsnotify.Op
+	name string
+}{
+	{fsnotify.Create, "create"},
+	{fsnotify.Write, "write"},
+	{fsnotify.Remove, "remove"},
+	{fsnotify.Rename, "rename"},
+	{fsnotify.Chmod, "chmod"},
+}
+
+// defaultEvents are the operations that are watched by default
+const defaultEvents = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename
+
+// defaultBatchDelay is the quiet period of a batch watcher without debounce
+const defaultBatchDelay = 100 * time.Millisecond
+
+// opNames returns the names of the operations in op, separated by "|"
+func opNames(op fsnotify.Op) string {
+	var names []string
+	for _, o := range ops {
+		if op&o.op == o.op {
+			names = append(names, o.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// parseOp returns the operation with the name
+func parseOp(name string) (fsnotify.Op, bool) {
+	for _, o := range ops {
+		if o.name == name {
+			return o.op, true
+		}
+	}
+	return 0, false
+}
+
 type watcher struct {
 	callback  lua.LValue
+	owner     *job
 	dir       string
 	recursive bool
 	filter    *regexp.Regexp
+	includes  []string
 	excludes  []string
+	events    fsnotify.Op
+
+	// root is the absolute path of dir, include and exclude globs are matched
+	// against paths relative to it
+	root   string
+	hidden bool
+	ignore bool
+	rules  ignoreRules
+
+	// debounce is the quiet period after the last event before the callback
+	// is called, batch watchers are called with all changes in the period
+	debounce time.Duration
+	batch    bool
+	changes  []change
+
+	// backend reports the file events, interval is the scan interval of the
+	// poll backend, which is also used when the watch limit is reached
+	backend  backend
+	interval time.Duration
+}
 
-	fsWatcher *fsnotify.Watcher
+// change is a file changed during the quiet period of a debounced watcher,
+// with all operations on the file
+type change struct {
+	file string
+	op   fsnotify.Op
 }
 
-func newWatcher(args *lua.LTable) *watcher {
+// newWatcher returns a watcher configured by args, a relative dir is relative
+// to the directory of the owner, the target that registered the watcher
+func newWatcher(args *lua.LTable, owner *job) *watcher {
 	var err error
 
 	w := &watcher{
 		callback:  args.RawGetString("callback"),
+		owner:     owner,
 		dir:       lua.LVAsString(args.RawGetString("dir")),
 		recursive: lua.LVAsBool(args.RawGetString("recursive")),
 		filter:    regexp.MustCompile(lua.LVAsString(args.RawGetString("filter"))),
+		includes:  stringList(args, "include"),
+		excludes:  stringList(args, "exclude"),
+		events:    defaultEvents,
+		hidden:    lua.LVAsBool(args.RawGetString("hidden")),
+		ignore:    lua.LVAsBool(args.RawGetString("ignore")),
+		batch:     lua.LVAsBool(args.RawGetString("batch")),
+	}
+	if owner != nil && owner.dir != "" && !filepath.IsAbs(w.dir) {
+		w.dir = filepath.Join(owner.dir, w.dir)
+		if rel, err := filepath.Rel(absPath("."), w.dir); err == nil {
+			w.dir = rel
+		}
+	}
+	w.root = absPath(w.dir)
+
+	if debounce, ok := args.RawGetString("debounce").(lua.LNumber); ok {
+		if debounce < 0 {
+			emitFatal("fatal: negative debounce: %v\n", debounce)
+		}
+		w.debounce = time.Duration(float64(debounce) * float64(time.Second))
+	}
+	if w.batch && w.debounce == 0 {
+		w.debounce = defaultBatchDelay
 	}
 
-	if tbl, ok := args.RawGetString("exclude").(*lua.LTable); ok {
-		w.excludes = make([]string, tbl.Len())
-		i := 0
+	if tbl, ok := args.RawGetString("events").(*lua.LTable); ok {
+		w.events = 0
 		tbl.ForEach(func(key, value lua.LValue) {
-			w.excludes[i] = lua.LVAsString(value)
-			i++
+			op, ok := parseOp(lua.LVAsString(value))
+			if !ok {
+				emitFatal("fatal: unknown event: %v\n", value)
+			}
+			w.events |= op
 		})
 	}
 
@@ -53,60 +148,142 @@ func newWatcher(args *lua.LTable) *watcher {
 		emitFatal("fatal: callback not defined or not function")
 	}
 
-	w.fsWatcher, err = fsnotify.NewWatcher()
-	if err != nil {
-		emitFatal("fatal: %v", err)
+	w.interval = defaultPollInterval
+	if interval, ok := args.RawGetString("interval").(lua.LNumber); ok {
+		if interval <= 0 {
+			emitFatal("fatal: interval must be positive: %v\n", interval)
+		}
+		w.interval = time.Duration(float64(interval) * float64(time.Second))
+	}
+
+	switch name := lua.LVAsString(args.RawGetString("backend")); name {
+	case "", "fsnotify":
+		w.backend, err = newFsnotifyBackend()
+		if err != nil {
+			emitFatal("fatal: %v", err)
+		}
+	case "poll":
+		w.backend = newPollBackend(w.interval)
+	default:
+		emitFatal("fatal: unknown backend: %v\n", name)
 	}
 
 	return w
 }
 
+// stringList returns the strings of the table field of args
+func stringList(args *lua.LTable, field string) []string {
+	var strs []string
+	if tbl, ok := args.RawGetString(field).(*lua.LTable); ok {
+		tbl.ForEach(func(key, value lua.LValue) {
+			strs = append(strs, lua.LVAsString(value))
+		})
+	}
+	return strs
+}
+
 func (w *watcher) start(L *lua.LState) error {
-	pause()
-	go w.watch(L)
+	addSource()
+	if w.ignore {
+		w.rules = parentIgnoreRules(w.root)
+	}
 	err := w.addWatchers(w.dir)
+	go w.watch(L)
 	return err
 }
 
 func (w *watcher) watch(L *lua.LState) {
+	var quiet <-chan time.Time
 	for {
 		select {
-		case event := <-w.fsWatcher.Events:
-			w.processFileEvent(L, event)
-		case err := <-w.fsWatcher.Errors:
+		case event := <-w.backend.Events():
+			if w.processFileEvent(L, event) {
+				quiet = time.After(w.debounce)
+			}
+		case <-quiet:
+			quiet = nil
+			w.flush(L)
+		case err := <-w.backend.Errors():
 			emit("watcher: %v", err)
 		case <-done:
 			emit("Closing watcher")
-			w.fsWatcher.Close()
+			w.backend.Close()
 			return
 		}
 	}
 }
 
-func (w *watcher) processFileEvent(L *lua.LState, event fsnotify.Event) {
+// processFileEvent queues a call of the callback, or adds the event to the
+// changes of a debounced watcher, in that case true is returned
+func (w *watcher) processFileEvent(L *lua.LState, event fsnotify.Event) bool {
 	emit("event: %v", event)
-	if event.Op&fsnotify.Write == fsnotify.Write {
-		if w.filter.MatchString(event.Name) {
-			emit("modified file: %v", event.Name)
-			w.notify(L, event)
+
+	fi, err := os.Stat(event.Name)
+	isDir := err == nil && fi.IsDir()
+
+	// watch directories created in a recursively watched directory
+	if event.Op&fsnotify.Create == fsnotify.Create && w.recursive && isDir && !w.skip(event.Name, true) {
+		if err := w.addWatchers(event.Name); err != nil {
+			emit("watcher: %v", err)
 		}
 	}
+
+	op := event.Op & w.events
+	if op == 0 || !w.filter.MatchString(event.Name) || !w.included(event.Name, isDir) {
+		return false
+	}
+
+	emit("%v file: %v", opNames(op), event.Name)
+	if w.debounce > 0 {
+		w.addChange(event.Name, op)
+		return true
+	}
+
+	post(func() {
+		callback(L, w.owner, w.callback, lua.LString(event.Name), lua.LString(opNames(op)))
+	})
+	return false
 }
 
-func (w *watcher) notify(L *lua.LState, event fsnotify.Event) {
-	if err := L.CallByParam(lua.P{
-		Fn:      w.callback,
-		NRet:    1,
-		Protect: true,
-	}, lua.LString(event.Name), lua.LString("write")); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+// addChange adds the operation on the file to the changes, the changes are
+// ordered by the last operation
+func (w *watcher) addChange(file string, op fsnotify.Op) {
+	for i, c := range w.changes {
+		if c.file == file {
+			op |= c.op
+			w.changes = append(w.changes[:i], w.changes[i+1:]...)
+			break
+		}
 	}
-	res := L.Get(-1)
-	L.Pop(1)
-	if b, ok := res.(lua.LBool); ok && b == false {
-		emitFatal("%v", errAbort)
+	w.changes = append(w.changes, change{file: file, op: op})
+}
+
+// flush queues a call of the callback with the changes of the quiet period. A
+// batch watcher gets a list of all changes, otherwise the last change is used.
+func (w *watcher) flush(L *lua.LState) {
+	changes := w.changes
+	w.changes = nil
+	if len(changes) == 0 {
+		return
 	}
+
+	emit("Flushing %v changes", len(changes))
+	post(func() {
+		if !w.batch {
+			last := changes[len(changes)-1]
+			callback(L, w.owner, w.callback, lua.LString(last.file), lua.LString(opNames(last.op)))
+			return
+		}
+
+		tbl := L.NewTable()
+		for _, c := range changes {
+			t := L.NewTable()
+			t.RawSetString("file", lua.LString(c.file))
+			t.RawSetString("op", lua.LString(opNames(c.op)))
+			tbl.Append(t)
+		}
+		callback(L, w.owner, w.callback, tbl)
+	})
 }
 
 func (w *watcher) addWatchers(name string) error {
@@ -121,7 +298,10 @@ func (w *watcher) addWatchers(name string) error {
 		return err
 	}
 
-	err = w.fsWatcher.Add(name)
+	err = w.backend.Add(name)
+	if err != nil && watchLimit(err) && w.usePoll() {
+		err = w.backend.Add(name)
+	}
 	if err != nil {
 		return err
 	}
@@ -132,6 +312,10 @@ func (w *watcher) addWatchers(name string) error {
 		emit("watch: Adding directory %v", name)
 	}
 
+	if w.ignore && fi.IsDir() {
+		w.rules = append(w.rules, readIgnoreFiles(absPath(name))...)
+	}
+
 	if !w.recursive {
 		return nil
 	}
@@ -142,17 +326,13 @@ func (w *watcher) addWatchers(name string) error {
 		return fmt.Errorf("error reading dir %v: %v", name, err)
 	}
 
-Next:
 	for _, file := range files {
-		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
-			continue Next
+		if !file.IsDir() {
+			continue
 		}
-
-		for _, exclude := range w.excludes {
-			if strings.Contains(file.Name(), exclude) {
-				emit("Skipping: %v/%v", name, file.Name())
-				continue Next
-			}
+		if w.skip(filepath.Join(name, file.Name()), true) {
+			emit("Skipping: %v/%v", name, file.Name())
+			continue
 		}
 
 		err = w.addWatchers(fmt.Sprintf("%v/%v", name, file.Name()))
@@ -163,3 +343,67 @@ Next:
 
 	return nil
 }
+
+// usePoll switches to the poll backend when the watch limit of fsnotify is
+// reached, the watched directories are added to the poll backend. It returns
+// false if the poll backend is already used.
+func (w *watcher) usePoll() bool {
+	old, ok := w.backend.(*fsnotifyBackend)
+	if !ok {
+		return false
+	}
+
+	emit("watch: limit of watches reached, falling back to polling")
+	old.Close()
+	w.backend = newPollBackend(w.interval)
+	for _, name := range old.names {
+		if err := w.backend.Add(name); err != nil {
+			emit("watcher: %v", err)
+		}
+	}
+	return true
+}
+
+// skip checks if a path is excluded from the watch. Hidden directories are
+// skipped unless the hidden option is set, and .git always is.
+func (w *watcher) skip(name string, isDir bool) bool {
+	file := absPath(name)
+	base := filepath.Base(file)
+	if isDir && file != w.root && (base == ".git" || !w.hidden && strings.HasPrefix(base, ".")) {
+		return true
+	}
+
+	rel, err := filepath.Rel(w.root, file)
+	if err != nil {
+		return false
+	}
+	for _, exclude := range w.excludes {
+		if matchGlob(exclude, filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+
+	return w.ignore && w.rules.ignored(file, isDir)
+}
+
+// included checks if the events of a file are processed, it must match an
+// include glob, if there are any, and not be excluded
+func (w *watcher) included(name string, isDir bool) bool {
+	if w.skip(name, isDir) {
+		return false
+	}
+	if len(w.includes) == 0 {
+		return true
+	}
+
+	rel, err := filepath.Rel(w.root, absPath(name))
+	if err != nil {
+		return false
+	}
+	for _, include := range w.includes {
+		if matchGlob(include, filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+func TestOpNames(t *testing.T) {
+	tests := []struct {
+		op    fsnotify.Op
+		names string
+	}{
+		{fsnotify.Write, "write"},
+		{fsnotify.Create | fsnotify.Write, "create|write"},
+		{defaultEvents, "create|write|remove|rename"},
+		{defaultEvents | fsnotify.Chmod, "create|write|remove|rename|chmod"},
+	}
+
+	for _, test := range tests {
+		if names := opNames(test.op); names != test.names {
+			t.Errorf("%v: expected %v, got %v", test.op, test.names, names)
+		}
+	}
+
+	for _, o := range ops {
+		if op, ok := parseOp(o.name); !ok || op != o.op {
+			t.Errorf("%v: expected %v, got %v", o.name, o.op, op)
+		}
+	}
+	if _, ok := parseOp("modify"); ok {
+		t.Errorf("expected unknown event")
+	}
+}
+
+func TestWatcherEvents(t *testing.T) {
+	all := []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod}
+
+	tests := []struct {
+		events  string
+		ops     []fsnotify.Op
+		changes []string
+	}{
+		{events: "nil", ops: all, changes: []string{"create", "write", "remove", "rename"}},
+		{events: `{"write"}`, ops: all, changes: []string{"write"}},
+		{events: `{"chmod", "create"}`, ops: all, changes: []string{"create", "chmod"}},
+		{events: `{"write"}`, ops: []fsnotify.Op{fsnotify.Create | fsnotify.Write}, changes: []string{"write"}},
+		{events: "nil", ops: []fsnotify.Op{fsnotify.Write | fsnotify.Chmod}, changes: []string{"write"}},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	for _, test := range tests {
+		// a debounced watcher collects the changes instead of calling back
+		if err := L.DoString(`return {callback=function() end, dir=".", debounce=1, events=` + test.events + `}`); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w := newWatcher(L.Get(-1).(*lua.LTable), nil)
+		L.Pop(1)
+
+		for i, op := range test.ops {
+			w.processFileEvent(L, fsnotify.Event{Name: "file" + strconv.Itoa(i), Op: op})
+		}
+		w.backend.Close()
+
+		var changes []string
+		for _, c := range w.changes {
+			changes = append(changes, opNames(c.op))
+		}
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%v: expected %v, got %v", test.events, test.changes, changes)
+		}
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	type event struct {
+		file string
+		op   fsnotify.Op
+	}
+
+	tests := []struct {
+		batch  bool
+		events []event
+		got    string
+	}{
+		{
+			events: nil,
+			got:    "nil",
+		},
+		{
+			// the last change is used, with all operations on the file
+			events: []event{{"a", fsnotify.Write}, {"b", fsnotify.Write}, {"a", fsnotify.Create}},
+			got:    "a:create|write",
+		},
+		{
+			batch:  true,
+			events: []event{{"a", fsnotify.Write}, {"b", fsnotify.Write}, {"a", fsnotify.Create}},
+			got:    "b:write a:create|write",
+		},
+		{
+			batch:  true,
+			events: []event{{"a", fsnotify.Create}, {"a", fsnotify.Write}, {"a", fsnotify.Chmod}, {"a", fsnotify.Remove}},
+			got:    "a:create|write|remove",
+		},
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	err := L.DoString(`callback = function(file, op)
+		if type(file) ~= "table" then
+			got = file .. ":" .. op
+			return
+		end
+
+		local changes = {}
+		for _, c in ipairs(file) do
+			changes[#changes + 1] = c.file .. ":" .. c.op
+		end
+		got = table.concat(changes, " ")
+	end`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, test := range tests {
+		L.SetGlobal("got", lua.LNil)
+		args := L.NewTable()
+		args.RawSetString("callback", L.GetGlobal("callback"))
+		args.RawSetString("dir", lua.LString("."))
+		args.RawSetString("debounce", lua.LNumber(1))
+		args.RawSetString("batch", lua.LBool(test.batch))
+		w := newWatcher(args, nil)
+
+		for _, e := range test.events {
+			w.processFileEvent(L, fsnotify.Event{Name: e.file, Op: e.op})
+		}
+		w.flush(L)
+		w.backend.Close()
+
+		select {
+		case ev := <-events:
+			ev()
+		default:
+		}
+
+		if got := L.GetGlobal("got").String(); got != test.got {
+			t.Errorf("%v: expected %v, got %v", i, test.got, got)
+		}
+		if len(w.changes) != 0 {
+			t.Errorf("%v: expected the changes to be flushed, got %v", i, w.changes)
+		}
+	}
+}